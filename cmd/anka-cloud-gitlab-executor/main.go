@@ -8,9 +8,12 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/audit"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/command"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/version"
 )
 
@@ -54,12 +57,17 @@ func run() int {
 		systemFailureExitCode = systemFailureExitCodeEnvVar
 	}
 
-	if err := command.Execute(ctx); err != nil {
-		log.Printf("error: %s", err)
+	err := command.Execute(ctx)
+	exitCode := 0
+	if err != nil {
+		log.Errorf("%s\n", err)
+		exitCode = buildFailureExitCode
 		if errors.Is(err, gitlab.ErrTransient) {
-			return systemFailureExitCode
+			exitCode = systemFailureExitCode
 		}
-		return buildFailureExitCode
 	}
-	return 0
+	audit.EndStage(exitCode, err)
+	metrics.Flush(context.Background())
+	tracing.Flush(context.Background(), err)
+	return exitCode
 }
@@ -5,7 +5,10 @@ go 1.24.4
 require (
 	github.com/spf13/cobra v1.7.0
 	github.com/spf13/pflag v1.0.5
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78
 	golang.org/x/crypto v0.45.0
+	golang.org/x/net v0.47.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
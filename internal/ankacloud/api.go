@@ -30,6 +30,7 @@ type CreateInstanceRequest struct {
 	StartupScriptCondition  StartupScriptCondition `json:"startup_script_condition"`
 	Vcpu                    int                    `json:"vcpu,omitempty"`
 	VramMb                  int                    `json:"vram,omitempty"`
+	Metadata                map[string]string      `json:"metadata,omitempty"`
 }
 
 type createInstanceResponse struct {
@@ -60,6 +61,18 @@ type getAllInstancesResponse struct {
 type GetNodeRequest struct {
 	Id string
 }
+type ControllerStatus struct {
+	Status          string `json:"status"`
+	Version         string `json:"version"`
+	RegistryAddress string `json:"registry_address"`
+	RegistryStatus  string `json:"registry_status"`
+}
+
+type getStatusResponse struct {
+	response
+	Status ControllerStatus `json:"body"`
+}
+
 type getNodeResponse struct {
 	response
 	Nodes []Node `json:"body"`
@@ -69,3 +82,53 @@ type getTemplatesResponse struct {
 	response
 	Templates []Template `json:"body"`
 }
+
+type SaveImageRequest struct {
+	InstanceId       string `json:"id"`
+	TemplateId       string `json:"target_vm_id,omitempty"`
+	Tag              string `json:"tag"`
+	Description      string `json:"description,omitempty"`
+	RevertBeforePush bool   `json:"revert_before_push"`
+}
+
+type saveImageResponse struct {
+	response
+	RequestId string `json:"body"`
+}
+
+type SaveImageRequestStatus string
+
+const (
+	SaveImageStatusPending SaveImageRequestStatus = "pending"
+	SaveImageStatusDone    SaveImageRequestStatus = "done"
+	SaveImageStatusError   SaveImageRequestStatus = "error"
+)
+
+type SaveImageRequestInfo struct {
+	Id          string                 `json:"id"`
+	Status      SaveImageRequestStatus `json:"status"`
+	Tag         string                 `json:"tag"`
+	TemplateId  string                 `json:"target_vm_id"`
+	ErrorReason string                 `json:"error_reason,omitempty"`
+}
+
+type getSaveImageRequestsResponse struct {
+	response
+	Requests []SaveImageRequestInfo `json:"body"`
+}
+
+type TemplateVersion struct {
+	Number int    `json:"number"`
+	Tag    string `json:"tag"`
+}
+
+type TemplateDetails struct {
+	Id       string            `json:"id"`
+	Name     string            `json:"name"`
+	Versions []TemplateVersion `json:"versions"`
+}
+
+type getTemplateResponse struct {
+	response
+	Template TemplateDetails `json:"body"`
+}
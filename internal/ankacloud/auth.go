@@ -0,0 +1,113 @@
+package ankacloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+// Authenticator adds credentials to controller requests
+type Authenticator interface {
+	Authorize(ctx context.Context, req *http.Request) error
+	// Invalidate drops cached credentials after the controller rejected them
+	Invalidate()
+}
+
+type cachedToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+func (t cachedToken) valid(now time.Time, skew time.Duration) bool {
+	if t.Token == "" {
+		return false
+	}
+	return t.ExpiresAt.IsZero() || now.Add(skew).Before(t.ExpiresAt)
+}
+
+// tokenCache keeps a token on disk, so the separate stage processes of a job
+// (and of other jobs on the same runner host) can share it
+type tokenCache struct {
+	path string
+}
+
+func newTokenCache(dir string, key string) *tokenCache {
+	if dir == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	return &tokenCache{path: filepath.Join(dir, hex.EncodeToString(sum[:16])+".json")}
+}
+
+func (c *tokenCache) load() cachedToken {
+	var token cachedToken
+	if c == nil {
+		return token
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Debugf("failed to read token cache %q: %s\n", c.path, err)
+		}
+		return token
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		log.Debugf("failed to parse token cache %q: %s\n", c.path, err)
+	}
+	return token
+}
+
+func (c *tokenCache) store(token cachedToken) {
+	if c == nil {
+		return
+	}
+
+	if err := c.write(token); err != nil {
+		log.Debugf("failed to write token cache: %s\n", err)
+	}
+}
+
+func (c *tokenCache) write(token cachedToken) error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("failed to create token cache dir: %w", err)
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+func (c *tokenCache) clear() {
+	if c == nil {
+		return
+	}
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Debugf("failed to remove token cache %q: %s\n", c.path, err)
+	}
+}
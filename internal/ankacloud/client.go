@@ -4,16 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/proxy"
 )
 
 const (
@@ -28,6 +27,11 @@ type APIClient struct {
 	ControllerURL     string
 	HttpClient        *http.Client
 	CustomHttpHeaders map[string]string
+	Authenticator     Authenticator
+	// RetryConfig tunes the retries of failed requests, DefaultRetryConfig if unset
+	RetryConfig RetryConfig
+	// Middlewares run on every request attempt, see Use
+	Middlewares []Middleware
 }
 
 // RetryConfig holds configuration for retry behavior with exponential backoff
@@ -46,70 +50,6 @@ func DefaultRetryConfig() RetryConfig {
 	}
 }
 
-// IsRetryableError checks if an error is retryable (timeout or transient errors)
-func IsRetryableError(err error) bool {
-	if err == nil {
-		return false
-	}
-	// Check for TransientError (which wraps timeout errors)
-	if errors.Is(err, gitlab.ErrTransient) {
-		return true
-	}
-	// Check for url.Error timeout
-	var urlErr *url.Error
-	if errors.As(err, &urlErr) && urlErr.Timeout() {
-		return true
-	}
-	// Also check for common timeout error messages
-	errStr := err.Error()
-	return strings.Contains(errStr, "deadline exceeded") ||
-		strings.Contains(errStr, "Client.Timeout")
-}
-
-// WithRetry executes the given operation with retry logic using exponential backoff
-func WithRetry[T any](ctx context.Context, config RetryConfig, operation func() (T, error)) (T, error) {
-	var zero T
-	var lastErr error
-	delay := config.InitialDelay
-
-	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
-		result, err := operation()
-		if err == nil {
-			return result, nil
-		}
-
-		lastErr = err
-
-		if !IsRetryableError(err) {
-			return zero, err
-		}
-
-		if attempt < config.MaxAttempts {
-			log.Printf("Request timed out (attempt %d/%d), retrying in %v...\n", attempt, config.MaxAttempts, delay)
-			select {
-			case <-ctx.Done():
-				return zero, ctx.Err()
-			case <-time.After(delay):
-			}
-			// Exponential backoff: double the delay for next attempt, capped at MaxDelay
-			delay *= 2
-			if delay > config.MaxDelay {
-				delay = config.MaxDelay
-			}
-		}
-	}
-
-	return zero, fmt.Errorf("operation failed after %d attempts: %w", config.MaxAttempts, lastErr)
-}
-
-// WithRetryNoResult executes the given operation with retry logic for operations that don't return a value
-func WithRetryNoResult(ctx context.Context, config RetryConfig, operation func() error) error {
-	_, err := WithRetry(ctx, config, func() (struct{}, error) {
-		return struct{}{}, operation()
-	})
-	return err
-}
-
 func (c *APIClient) parse(body []byte) (response, error) {
 	var r response
 	err := json.Unmarshal(body, &r)
@@ -124,30 +64,6 @@ func (c *APIClient) parse(body []byte) (response, error) {
 	return r, nil
 }
 
-// readResponseBodyWithRetry reads the response body and retries once on unexpected EOF
-func (c *APIClient) readResponseBodyWithRetry(resp *http.Response, req *http.Request) ([]byte, *http.Response, error) {
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		if strings.Contains(err.Error(), "unexpected EOF") {
-			time.Sleep(5 * time.Second)
-			// Retry once on unexpected EOF
-			retryResp, retryErr := c.HttpClient.Do(req)
-			if retryErr != nil {
-				return nil, nil, retryErr
-			}
-			defer retryResp.Body.Close()
-
-			bodyBytes, retryErr = io.ReadAll(retryResp.Body)
-			if retryErr != nil {
-				return nil, nil, fmt.Errorf("failed to read response body (retry): %w", retryErr)
-			}
-			return bodyBytes, retryResp, nil
-		}
-		return nil, nil, fmt.Errorf("failed to read response body: %w", err)
-	}
-	return bodyBytes, resp, nil
-}
-
 func toQueryParams(params map[string]string) url.Values {
 	query := url.Values{}
 	for k, v := range params {
@@ -157,164 +73,133 @@ func toQueryParams(params map[string]string) url.Values {
 }
 
 func (c *APIClient) Post(ctx context.Context, endpoint string, payload interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse POST request body %+v: %w", payload, err)
-	}
-
-	endpointUrl := fmt.Sprintf("%s%s", c.ControllerURL, endpoint)
+	return c.send(ctx, http.MethodPost, endpoint, nil, payload)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointUrl, &buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create POST request to %q with body %+v: %w", endpointUrl, payload, err)
-	}
+func (c *APIClient) Delete(ctx context.Context, endpoint string, payload interface{}) ([]byte, error) {
+	return c.send(ctx, http.MethodDelete, endpoint, nil, payload)
+}
 
-	for k, v := range c.CustomHttpHeaders {
-		log.Debugf("Setting custom header %s: %s\n", k, v)
-		req.Header.Set(k, v)
-	}
+func (c *APIClient) Get(ctx context.Context, endpoint string, queryParams map[string]string) ([]byte, error) {
+	return c.send(ctx, http.MethodGet, endpoint, queryParams, nil)
+}
 
-	r, err := c.HttpClient.Do(req)
-	if err != nil {
-		if e, ok := err.(*url.Error); ok && e.Timeout() {
-			return nil, gitlab.TransientError(fmt.Errorf("failed to send POST request to %s with payload %+v: %w", endpointUrl, payload, e))
-		}
-		return nil, fmt.Errorf("failed to send POST request to %s with body %+v: %w", endpointUrl, payload, err)
+// send is the single request core: every controller request goes through the middleware pipeline,
+// and its response is checked the same way.
+func (c *APIClient) send(ctx context.Context, method string, endpoint string, queryParams map[string]string, payload any) ([]byte, error) {
+	if len(queryParams) > 0 {
+		endpoint = fmt.Sprintf("%s?%s", endpoint, toQueryParams(queryParams).Encode())
 	}
-	defer r.Body.Close()
+	endpointUrl := fmt.Sprintf("%s%s", c.ControllerURL, endpoint)
 
-	bodyBytes, r, err := c.readResponseBodyWithRetry(r, req)
-	if err != nil {
-		if e, ok := err.(*url.Error); ok && e.Timeout() {
-			return nil, gitlab.TransientError(fmt.Errorf("failed to send POST request to %s with payload %+v (retry): %w", endpointUrl, payload, e))
+	// the body is kept in memory, so it can be replayed on retries
+	var body io.Reader
+	if method != http.MethodGet {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s request body %+v: %w", method, payload, err)
 		}
-		return nil, err
+		body = bytes.NewReader(data)
 	}
 
-	baseResponse, err := c.parse(bodyBytes)
+	req, err := http.NewRequestWithContext(ctx, method, endpointUrl, body)
 	if err != nil {
-		return nil, fmt.Errorf("status code: %d, error: %w", r.StatusCode, err)
-	}
-
-	if r.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code: %d, error: %s", r.StatusCode, baseResponse.Message)
+		return nil, fmt.Errorf("failed to create %s request to %q: %w", method, endpointUrl, err)
 	}
-
-	log.Debugf("POST request sent to %s\nRaw payload: %+v\nResponse status code: %d\nRaw body: %+v\n", endpoint, payload, r.StatusCode, string(bodyBytes))
-	return bodyBytes, nil
-}
-
-func (c *APIClient) Delete(ctx context.Context, endpoint string, payload interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse DELETE request body %+v: %w", payload, err)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
+	// lets a failure be matched with the controller logs
+	req.Header.Set(requestIdHeader, newRequestId())
 
-	endpointUrl := fmt.Sprintf("%s%s", c.ControllerURL, endpoint)
-	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpointUrl, &buf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create DELETE request to %q with payload %+v: %w", endpointUrl, payload, err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	for k, v := range c.CustomHttpHeaders {
-		log.Debugf("Setting custom header %s: %s\n", k, v)
-		req.Header.Set(k, v)
-	}
-
-	r, err := c.HttpClient.Do(req)
+	r, err := c.handler()(req)
 	if err != nil {
 		if e, ok := err.(*url.Error); ok && e.Timeout() {
-			return nil, gitlab.TransientError(fmt.Errorf("failed to send DELETE request to %s with payload %+v: %w", endpointUrl, payload, e))
+			return nil, gitlab.TransientError(fmt.Errorf("failed to send %s request to %s: %w", method, endpointUrl, e))
 		}
-		return nil, fmt.Errorf("failed to send DELETE request to %s with payload %+v: %w", endpoint, payload, err)
+		return nil, fmt.Errorf("failed to send %s request to %s: %w", method, endpointUrl, describeTLSError(err))
 	}
 	defer r.Body.Close()
 
-	bodyBytes, r, err := c.readResponseBodyWithRetry(r, req)
-	if err != nil {
-		if e, ok := err.(*url.Error); ok && e.Timeout() {
-			return nil, gitlab.TransientError(fmt.Errorf("failed to send DELETE request to %s with payload %+v (retry): %w", endpointUrl, payload, e))
-		}
-		return nil, err
-	}
-
-	baseResponse, err := c.parse(bodyBytes)
-	if err != nil {
-		return nil, fmt.Errorf("status code: %d, error: %w", r.StatusCode, err)
-	}
-
-	if r.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code: %d, error: %s", r.StatusCode, baseResponse.Message)
-	}
-
-	log.Debugf("DELETE request sent to %s\n Raw payload: %+v\nResponse status code: %d\nRaw body: %+v\n", endpoint, payload, r.StatusCode, string(bodyBytes))
-	return bodyBytes, nil
-}
-
-func (c *APIClient) Get(ctx context.Context, endpoint string, queryParams map[string]string) ([]byte, error) {
-	if len(queryParams) > 0 {
-		params := toQueryParams(queryParams)
-		endpoint = fmt.Sprintf("%s?%s", endpoint, params.Encode())
-	}
-	endpointUrl := fmt.Sprintf("%s%s", c.ControllerURL, endpoint)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpointUrl, nil)
+	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GET request to %q: %w", endpointUrl, err)
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	for k, v := range c.CustomHttpHeaders {
-		log.Debugf("Setting custom header %s: %s\n", k, v)
-		req.Header.Set(k, v)
-	}
-
-	r, err := c.HttpClient.Do(req)
-	if err != nil {
-		if e, ok := err.(*url.Error); ok && e.Timeout() {
-			return nil, gitlab.TransientError(fmt.Errorf("failed to send GET request to %s: %w", endpointUrl, e))
-		}
-		return nil, fmt.Errorf("failed to send GET request to %s: %w", endpointUrl, err)
+	apiErr := &APIError{
+		StatusCode: r.StatusCode,
+		Method:     method,
+		Endpoint:   endpoint,
+		RequestId:  req.Header.Get(requestIdHeader),
 	}
-	defer r.Body.Close()
-
-	bodyBytes, r, err := c.readResponseBodyWithRetry(r, req)
-	if err != nil {
-		if e, ok := err.(*url.Error); ok && e.Timeout() {
-			return nil, gitlab.TransientError(fmt.Errorf("failed to send GET request to %s (retry): %w", endpointUrl, e))
-		}
-		return nil, err
+	if responseRequestId := r.Header.Get(requestIdHeader); responseRequestId != "" {
+		apiErr.RequestId = responseRequestId
 	}
 
 	baseResponse, err := c.parse(bodyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("status code: %d, error: %w", r.StatusCode, err)
+		apiErr.Status = baseResponse.Status
+		apiErr.Message = baseResponse.Message
+		if baseResponse.Status == "" {
+			apiErr.Err = err
+		}
+		return nil, apiErr
 	}
 
 	if r.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code: %d, error: %s", r.StatusCode, baseResponse.Message)
+		apiErr.Status = baseResponse.Status
+		apiErr.Message = baseResponse.Message
+		return nil, apiErr
 	}
 
-	log.Debugf("GET request to %s\nResponse status code: %d\nRaw body: %+v\n", endpoint, r.StatusCode, string(bodyBytes))
-
+	if method == http.MethodGet {
+		log.HTTP.Tracef("GET request to %s\nResponse status code: %d\nRaw body: %+v\n", endpoint, r.StatusCode, string(bodyBytes))
+	} else {
+		log.HTTP.Tracef("%s request sent to %s\nRaw payload: %+v\nResponse status code: %d\nRaw body: %+v\n", method, endpoint, payload, r.StatusCode, string(bodyBytes))
+	}
 	return bodyBytes, nil
 }
 
 type APIClientConfig struct {
-	BaseURL             string
-	IsTLS               bool
-	CaCertPath          string
-	ClientCertPath      string
-	ClientCertKeyPath   string
+	BaseURL           string
+	IsTLS             bool
+	CaCertPath        string
+	ClientCertPath    string
+	ClientCertKeyPath string
+	// CaCertPEM, ClientCertPEM and ClientCertKeyPEM are inline alternatives to the files
+	CaCertPEM        string
+	ClientCertPEM    string
+	ClientCertKeyPEM string
+	// ClientCertP12Path is a PKCS#12 bundle with the client certificate and its key
+	ClientCertP12Path string
+	// ClientCertPassphrasePath holds the passphrase of the PKCS#12 bundle or the encrypted PKCS#8 key
+	ClientCertPassphrasePath string
+	// TLSMinVersion is "1.0" to "1.3", "1.2" by default
+	TLSMinVersion   string
+	TLSCipherSuites []string
+	// TLSPins are SPKI SHA-256 hashes, one of which the controller's certificate chain must match
+	TLSPins []string
+	// CertExpiryWarning warns in the job log about controller and client certs expiring within it
+	CertExpiryWarning   time.Duration
 	SkipTLSVerify       bool
 	MaxIdleConnsPerHost int
 	RequestTimeout      time.Duration
 	CustomHttpHeaders   map[string]string
+	UAKCredentialsPath  string
+	OAuth               OAuthConfig
+	// ProxyURL routes requests through an http, https or socks5 proxy, overriding the proxy env of the runner process
+	ProxyURL string
+	NoProxy  []string
+	// TokenCacheDir is where controller tokens are cached on the runner host, to be shared by stage processes
+	TokenCacheDir string
+	Retry         RetryConfig
 }
 
 func (c *APIClientConfig) certAuthEnabled() bool {
-	return c.ClientCertKeyPath != "" && c.ClientCertPath != ""
+	if c.ClientCertP12Path != "" {
+		return true
+	}
+	return (c.ClientCertPath != "" || c.ClientCertPEM != "") && (c.ClientCertKeyPath != "" || c.ClientCertKeyPEM != "")
 }
 
 func NewAPIClient(config APIClientConfig) (*APIClient, error) {
@@ -333,19 +218,53 @@ func NewAPIClient(config APIClientConfig) (*APIClient, error) {
 		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
 	}
 
+	if config.ProxyURL != "" {
+		proxyConfig, err := proxy.New(config.ProxyURL, config.NoProxy)
+		if err != nil {
+			return nil, err
+		}
+		log.HTTP.Debugf("using proxy %s\n", proxyConfig)
+		transport.Proxy = proxyConfig.HTTPProxy
+	}
+
 	if config.IsTLS {
 		tlsConfig, err := configureTLS(config)
 		if err != nil {
-			return nil, fmt.Errorf("failed to configure TLS %+v: %w", config, err)
+			return nil, fmt.Errorf("failed to configure TLS for %s: %w", config.BaseURL, err)
 		}
 		transport.TLSClientConfig = tlsConfig
 	}
 
 	httpClient.Transport = transport
 
-	return &APIClient{
+	apiClient := &APIClient{
 		ControllerURL:     config.BaseURL,
 		CustomHttpHeaders: config.CustomHttpHeaders,
 		HttpClient:        httpClient,
-	}, nil
+		RetryConfig:       config.Retry,
+	}
+
+	if config.UAKCredentialsPath != "" {
+		creds, err := LoadUAKCredentials(config.UAKCredentialsPath)
+		if err != nil {
+			return nil, err
+		}
+		apiClient.Authenticator, err = newUAKAuthenticator(config.BaseURL, httpClient, creds, config.TokenCacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.OAuth.Enabled() {
+		if apiClient.Authenticator != nil {
+			return nil, fmt.Errorf("UAK and OAuth authentication are mutually exclusive")
+		}
+		var err error
+		apiClient.Authenticator, err = newOAuthAuthenticator(config.OAuth, httpClient, config.TokenCacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return apiClient, nil
 }
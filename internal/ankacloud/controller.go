@@ -3,10 +3,15 @@ package ankacloud
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/audit"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
 )
 
 type Controller struct {
@@ -48,13 +53,26 @@ type PortForwardingRule struct {
 }
 
 type Instance struct {
-	State      InstanceState `json:"instance_state"`
-	Id         string        `json:"instance_id"`
-	ExternalId string        `json:"external_id"`
-	VMInfo     *VM           `json:"vminfo,omitempty"`
-	NodeId     string        `json:"node_id"`
-	Node       *Node         `json:"node,omitempty"`
-	Progress   float32       `json:"progress,omitempty"`
+	State        InstanceState     `json:"instance_state"`
+	Id           string            `json:"instance_id"`
+	ExternalId   string            `json:"external_id"`
+	VMInfo       *VM               `json:"vminfo,omitempty"`
+	NodeId       string            `json:"node_id"`
+	Node         *Node             `json:"node,omitempty"`
+	Progress     float32           `json:"progress,omitempty"`
+	CreationTime string            `json:"cr_time,omitempty"`
+	TemplateId   string            `json:"vmid,omitempty"`
+	Tag          string            `json:"tag,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// CreatedAt returns the time the controller created the instance, if it reported one.
+func (i *Instance) CreatedAt() (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, i.CreationTime)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
 }
 
 type InstanceWrapper struct {
@@ -68,6 +86,27 @@ func NewController(apiClient *APIClient) *Controller {
 		APIClient: apiClient,
 	}
 }
+
+// GetStatus reports the controller's health, for picking a working controller of an HA setup
+func (c *Controller) GetStatus(ctx context.Context) (*ControllerStatus, error) {
+	body, err := c.APIClient.Get(ctx, "/api/v1/status", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get controller status: %w", err)
+	}
+
+	var response getStatusResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response body %q: %w", string(body), err)
+	}
+
+	return &response.Status, nil
+}
+
+func (s ControllerStatus) IsRunning() bool {
+	return strings.EqualFold(s.Status, "running")
+}
+
 func (c *Controller) GetNode(ctx context.Context, req GetNodeRequest) (*Node, error) {
 	body, err := c.APIClient.Get(ctx, "/api/v1/node", map[string]string{"id": req.Id})
 	if err != nil {
@@ -102,12 +141,58 @@ func (c *Controller) GetInstance(ctx context.Context, req GetInstanceRequest) (*
 	return &response.Instance, nil
 }
 
+// CreateInstance creates the instance, making sure a job never gets two of them. When the outcome
+// of a creation request is unknown, the controller is asked for an instance with the same external id,
+// which is adopted if found, before creation is attempted again.
 func (c *Controller) CreateInstance(ctx context.Context, payload CreateInstanceRequest) (string, error) {
 
 	if payload.Priority < 0 || payload.Priority > 10000 {
 		return "", fmt.Errorf("priority must be between 1 and 10000. Got %d", payload.Priority)
 	}
 
+	config := c.APIClient.RetryConfig
+	if config.MaxAttempts < 1 {
+		config = DefaultRetryConfig()
+	}
+	delay := config.InitialDelay
+
+	for attempt := 1; ; attempt++ {
+		instanceId, err := c.createInstance(ctx, payload)
+		if err == nil {
+			return instanceId, nil
+		}
+		if attempt >= config.MaxAttempts || payload.ExternalId == "" || !isOutcomeUnknown(err) {
+			return "", err
+		}
+
+		log.Printf("instance creation failed (attempt %d/%d): %s, checking whether it was created anyway\n", attempt, config.MaxAttempts, err)
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, config.MaxDelay)
+
+		// an empty list is a valid answer here, unlike for GetInstancesByExternalId
+		instances, lookupErr := c.GetAllInstances(ctx)
+		if lookupErr != nil {
+			// creating another instance without knowing could leave one behind
+			return "", fmt.Errorf("%w (could not check whether the instance was created: %w)", err, lookupErr)
+		}
+		for _, instance := range instances {
+			if instance.ExternalId != payload.ExternalId {
+				continue
+			}
+			switch instance.State {
+			case StateStarted, StateScheduling, StatePulling:
+				log.Printf("adopting instance %s, created by the failed attempt\n", instance.Id)
+				return instance.Id, nil
+			}
+		}
+	}
+}
+
+func (c *Controller) createInstance(ctx context.Context, payload CreateInstanceRequest) (string, error) {
 	body, err := c.APIClient.Post(ctx, "/api/v1/vm", payload)
 	if err != nil {
 		return "", fmt.Errorf("failed to create instance %+v: %w", payload, err)
@@ -119,11 +204,25 @@ func (c *Controller) CreateInstance(ctx context.Context, payload CreateInstanceR
 		return "", fmt.Errorf("failed to parse response body %q: %w", string(body), err)
 	}
 
+	if len(response.InstanceIds) == 0 {
+		return "", fmt.Errorf("controller returned no instance id")
+	}
+
 	return response.InstanceIds[0], nil
 }
 
-func (c *Controller) WaitForInstanceToBeScheduled(ctx context.Context, instanceId string) (*Instance, error) {
+func (c *Controller) WaitForInstanceToBeScheduled(ctx context.Context, instanceId string) (instance *Instance, err error) {
 	const pollingInterval = 10 * time.Second
+	ctx, span := tracing.Start(ctx, "wait for instance", tracing.KindInternal)
+	span.SetAttribute("anka.instance.id", instanceId)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	var lastState InstanceState
+	stateSince := time.Now()
+	var section *log.Section
+	defer func() { section.End("instance %s did not start", instanceId) }()
 	for {
 		select {
 		case <-ctx.Done():
@@ -133,13 +232,20 @@ func (c *Controller) WaitForInstanceToBeScheduled(ctx context.Context, instanceI
 			if err != nil {
 				return nil, fmt.Errorf("failed to get instance %q status: %w", instanceId, err)
 			}
-			log.ConditionalColorf("instance %s is in state %q\n", instanceId, instance.State)
+			log.Controller.Colorf("instance %s is in state %q\n", instanceId, instance.State)
+			if instance.State != lastState {
+				audit.Record(audit.Event{Action: audit.ActionInstanceState, InstanceId: instanceId, State: string(instance.State)})
+				section = stateChanged(section, instanceId, lastState, time.Since(stateSince), instance)
+				span.SetAttribute("anka.instance.state", string(instance.State))
+				lastState = instance.State
+				stateSince = time.Now()
+			}
 			switch instance.State {
 			case StateScheduling:
 				break
 			case StatePulling:
 				if instance.Progress != 0 {
-					log.ConditionalColorf("pulling progress: %.0f%%\n", instance.Progress*100)
+					log.Controller.Colorf("pulling progress: %.0f%%\n", instance.Progress*100)
 				}
 			case StateStarted:
 				// get the rest of the node details
@@ -156,6 +262,32 @@ func (c *Controller) WaitForInstanceToBeScheduled(ctx context.Context, instanceI
 	}
 }
 
+// stateChanged ends the job log section of the previous state and records how long it lasted, then
+// starts the section of the new state. States other than the ones of a starting instance keep the
+// section open, to be ended as failed.
+func stateChanged(section *log.Section, instanceId string, previous InstanceState, inState time.Duration, instance *Instance) *log.Section {
+	switch instance.State {
+	case StateScheduling, StatePulling, StateStarted:
+	default:
+		return section
+	}
+	switch previous {
+	case StateScheduling:
+		metrics.Observe(metrics.QueueSeconds, inState.Seconds())
+		section.End("instance %s scheduled on node %s", instanceId, instance.NodeId)
+	case StatePulling:
+		metrics.Observe(metrics.PullSeconds, inState.Seconds())
+		section.End("template pulled to node %s", instance.NodeId)
+	}
+	switch instance.State {
+	case StateScheduling:
+		return log.StartSection("scheduling", "Waiting for a node to schedule instance %s", instanceId)
+	case StatePulling:
+		return log.StartSection("pulling", "Pulling template to node %s", instance.NodeId)
+	}
+	return nil
+}
+
 func (c *Controller) TerminateInstance(ctx context.Context, payload TerminateInstanceRequest) error {
 	body, err := c.APIClient.Delete(ctx, "/api/v1/vm", payload)
 	if err != nil {
@@ -171,15 +303,8 @@ func (c *Controller) TerminateInstance(ctx context.Context, payload TerminateIns
 	return nil
 }
 
-// TerminateInstanceWithRetry terminates an instance with automatic retry on timeout errors
-func (c *Controller) TerminateInstanceWithRetry(ctx context.Context, payload TerminateInstanceRequest) error {
-	return WithRetryNoResult(ctx, DefaultRetryConfig(), func() error {
-		return c.TerminateInstance(ctx, payload)
-	})
-}
-
 func (c *Controller) GetAllInstances(ctx context.Context) ([]Instance, error) {
-
+	start := time.Now()
 	body, err := c.APIClient.Get(ctx, "/api/v1/vm", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all instances: %w", err)
@@ -191,15 +316,13 @@ func (c *Controller) GetAllInstances(ctx context.Context) ([]Instance, error) {
 		return nil, fmt.Errorf("failed to parse response body %q: %w", string(body), err)
 	}
 
-	log.Debugf("got %d instances back from controller\n", len(response.Instances))
-	body, err = json.Marshal(response)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal response body %q: %w", string(body), err)
-	}
-	log.Debugf("instances response: %s\n", string(body))
+	log.Controller.Debugf("got %d instances back from controller (%d bytes in %s)\n", len(response.Instances), len(body), time.Since(start))
 
 	var instances []Instance
 	for _, instanceWrapper := range response.Instances {
+		if instanceWrapper.Instance == nil {
+			continue
+		}
 		instances = append(instances, *instanceWrapper.Instance)
 	}
 
@@ -207,12 +330,28 @@ func (c *Controller) GetAllInstances(ctx context.Context) ([]Instance, error) {
 }
 
 func (c *Controller) GetInstanceByExternalId(ctx context.Context, externalId string) (*Instance, error) {
-	return WithRetry(ctx, DefaultRetryConfig(), func() (*Instance, error) {
-		return c.getInstanceByExternalId(ctx, externalId)
-	})
+	matchingInstances, err := c.GetInstancesByExternalId(ctx, externalId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matchingInstances) == 0 {
+		return nil, fmt.Errorf("instance with external id %s not found", externalId)
+	}
+
+	instance := SelectUsableInstance(matchingInstances)
+	if instance == nil {
+		// No instances in a usable state - fail explicitly instead of returning Error/Terminated instances
+		return nil, fmt.Errorf("instance with external id %s exists but is not in a usable state (found state: %s)",
+			externalId, matchingInstances[0].State)
+	}
+
+	return instance, nil
 }
 
-func (c *Controller) getInstanceByExternalId(ctx context.Context, externalId string) (*Instance, error) {
+// GetInstancesByExternalId returns all instances with the external id, in any state.
+// Retried jobs can leave several of them behind.
+func (c *Controller) GetInstancesByExternalId(ctx context.Context, externalId string) ([]*Instance, error) {
 	instances, err := c.GetAllInstances(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get instance by external id %s: %w", externalId, err)
@@ -229,22 +368,56 @@ func (c *Controller) getInstanceByExternalId(ctx context.Context, externalId str
 		}
 	}
 
-	if len(matchingInstances) == 0 {
-		return nil, fmt.Errorf("instance with external id %s not found", externalId)
-	}
+	return matchingInstances, nil
+}
 
-	// If multiple instances with the same external ID exist, prioritize by state
-	// Return the first instance that is in a good state (Started, Scheduling, Pulling)
-	for _, instance := range matchingInstances {
+// SelectUsableInstance returns the first instance that is in a good state (Started, Scheduling, Pulling),
+// or nil if there is none.
+func SelectUsableInstance(instances []*Instance) *Instance {
+	for _, instance := range instances {
 		switch instance.State {
 		case StateStarted, StateScheduling, StatePulling:
-			return instance, nil
+			return instance
 		}
 	}
+	return nil
+}
+
+// WaitForInstancesToBeTerminated polls the instances until they all reach Terminated or the context is done.
+// It returns the ids of the instances whose termination could not be confirmed.
+func (c *Controller) WaitForInstancesToBeTerminated(ctx context.Context, instanceIds []string, pollingInterval time.Duration) []string {
+	pending := instanceIds
+	for {
+		var stillPending []string
+		for _, instanceId := range pending {
+			instance, err := c.GetInstance(ctx, GetInstanceRequest{Id: instanceId})
+			if errors.Is(err, ErrNotFound) {
+				// terminated instances are eventually forgotten by the controller
+				log.Controller.Debugf("instance %s is gone\n", instanceId)
+				continue
+			}
+			if err != nil {
+				log.Controller.Debugf("failed to get instance %s status: %s\n", instanceId, err)
+				stillPending = append(stillPending, instanceId)
+				continue
+			}
+			if instance.State != StateTerminated {
+				log.Controller.Debugf("instance %s is in state %q\n", instanceId, instance.State)
+				stillPending = append(stillPending, instanceId)
+			}
+		}
+		pending = stillPending
+
+		if len(pending) == 0 {
+			return nil
+		}
 
-	// No instances in a usable state - fail explicitly instead of returning Error/Terminated instances
-	return nil, fmt.Errorf("instance with external id %s exists but is not in a usable state (found state: %s)",
-		externalId, matchingInstances[0].State)
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-time.After(pollingInterval):
+		}
+	}
 }
 
 func (c *Controller) GetTemplateIdByName(ctx context.Context, templateName string) (string, error) {
@@ -265,5 +438,80 @@ func (c *Controller) GetTemplateIdByName(ctx context.Context, templateName strin
 		}
 	}
 
-	return "", fmt.Errorf("template %q not found", templateName)
+	return "", fmt.Errorf("template %q %w", templateName, ErrNotFound)
+}
+
+func (c *Controller) GetTemplate(ctx context.Context, templateId string) (*TemplateDetails, error) {
+	body, err := c.APIClient.Get(ctx, "/api/v1/registry/vm", map[string]string{"id": templateId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get template %q: %w", templateId, err)
+	}
+
+	var response getTemplateResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response body %q: %w", string(body), err)
+	}
+
+	return &response.Template, nil
+}
+
+// SaveImage asks the controller to save the instance's VM and push it to the registry as a new tag.
+// It returns the id of the save image request.
+func (c *Controller) SaveImage(ctx context.Context, payload SaveImageRequest) (string, error) {
+	body, err := c.APIClient.Post(ctx, "/api/v1/image", payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to save image %+v: %w", payload, err)
+	}
+
+	var response saveImageResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse response body %q: %w", string(body), err)
+	}
+
+	return response.RequestId, nil
+}
+
+func (c *Controller) GetSaveImageRequest(ctx context.Context, requestId string) (*SaveImageRequestInfo, error) {
+	body, err := c.APIClient.Get(ctx, "/api/v1/image", map[string]string{"id": requestId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get save image request %s: %w", requestId, err)
+	}
+
+	var response getSaveImageRequestsResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response body %q: %w", string(body), err)
+	}
+
+	for _, request := range response.Requests {
+		if request.Id == requestId {
+			return &request, nil
+		}
+	}
+
+	return nil, fmt.Errorf("save image request %s not found", requestId)
+}
+
+func (c *Controller) WaitForSaveImage(ctx context.Context, requestId string) (*SaveImageRequestInfo, error) {
+	const pollingInterval = 10 * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollingInterval):
+			request, err := c.GetSaveImageRequest(ctx, requestId)
+			if err != nil {
+				return nil, err
+			}
+			log.Controller.Colorf("save image request %s is %s\n", requestId, request.Status)
+			switch SaveImageRequestStatus(strings.ToLower(string(request.Status))) {
+			case SaveImageStatusDone:
+				return request, nil
+			case SaveImageStatusError:
+				return nil, fmt.Errorf("save image request %s failed: %s", requestId, request.ErrorReason)
+			}
+		}
+	}
 }
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGetInstanceByExternalId_PrioritizesActiveInstances(t *testing.T) {
@@ -300,3 +301,250 @@ func TestGetInstanceByExternalId_EmptyInstanceList(t *testing.T) {
 		t.Errorf("Expected 'no instances returned' error, got: %v", err)
 	}
 }
+
+func TestGetInstancesByExternalId_ReturnsAllStates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := getAllInstancesResponse{
+			response: response{Status: "OK"},
+			Instances: []InstanceWrapper{
+				{Instance: &Instance{Id: "error-instance", ExternalId: "https://gitlab.com/job/321", State: StateError}},
+				{Instance: &Instance{Id: "pulling-instance", ExternalId: "https://gitlab.com/job/321", State: StatePulling}},
+				{Instance: &Instance{Id: "other-instance", ExternalId: "https://gitlab.com/job/999", State: StateStarted}},
+			},
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	controller := NewController(&APIClient{
+		ControllerURL: server.URL,
+		HttpClient:    server.Client(),
+	})
+
+	instances, err := controller.GetInstancesByExternalId(context.Background(), "https://gitlab.com/job/321")
+	if err != nil {
+		t.Fatalf("Failed to get instances: %v", err)
+	}
+
+	if len(instances) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(instances))
+	}
+
+	if usable := SelectUsableInstance(instances); usable == nil || usable.Id != "pulling-instance" {
+		t.Errorf("Expected pulling instance to be usable, got %+v", usable)
+	}
+}
+
+func TestWaitForInstancesToBeTerminated(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		state := StateTerminated
+		switch id {
+		case "slow-instance":
+			// terminated on the second poll
+			if atomic.AddInt32(&calls, 1) < 2 {
+				state = StateTerminating
+			}
+		case "stuck-instance":
+			state = StateTerminating
+		case "gone-instance":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response{Status: "FAIL", Message: "instance not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(getInstanceResponse{
+			response: response{Status: "OK"},
+			Instance: Instance{Id: id, State: state},
+		})
+	}))
+	defer server.Close()
+
+	controller := NewController(&APIClient{
+		ControllerURL: server.URL,
+		HttpClient:    server.Client(),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	unconfirmed := controller.WaitForInstancesToBeTerminated(ctx, []string{"fast-instance", "slow-instance", "stuck-instance", "gone-instance"}, 10*time.Millisecond)
+	if len(unconfirmed) != 1 || unconfirmed[0] != "stuck-instance" {
+		t.Errorf("Expected only stuck-instance to be unconfirmed, got %v", unconfirmed)
+	}
+}
+
+func TestSaveImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/image" {
+			t.Errorf("Expected path /api/v1/image, got %s", r.URL.Path)
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var payload SaveImageRequest
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.InstanceId != "instance-id" || payload.TemplateId != "template-id" || payload.Tag != "baked" || !payload.RevertBeforePush {
+				t.Errorf("Unexpected payload %+v", payload)
+			}
+			json.NewEncoder(w).Encode(saveImageResponse{
+				response:  response{Status: "OK"},
+				RequestId: "request-id",
+			})
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(getSaveImageRequestsResponse{
+				response: response{Status: "OK"},
+				Requests: []SaveImageRequestInfo{
+					{Id: "request-id", Status: "Done", Tag: "baked"},
+				},
+			})
+		}
+	}))
+	defer server.Close()
+
+	controller := NewController(&APIClient{
+		ControllerURL: server.URL,
+		HttpClient:    server.Client(),
+	})
+
+	requestId, err := controller.SaveImage(context.Background(), SaveImageRequest{
+		InstanceId:       "instance-id",
+		TemplateId:       "template-id",
+		Tag:              "baked",
+		RevertBeforePush: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	if requestId != "request-id" {
+		t.Errorf("Expected request id 'request-id', got '%s'", requestId)
+	}
+
+	request, err := controller.GetSaveImageRequest(context.Background(), requestId)
+	if err != nil {
+		t.Fatalf("Failed to get save image request: %v", err)
+	}
+	if request.Tag != "baked" {
+		t.Errorf("Expected tag 'baked', got '%s'", request.Tag)
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/status" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"status":"OK","body":{"status":"Running","version":"1.40.0","registry_status":"Running"}}`))
+	}))
+	defer server.Close()
+
+	apiClient := &APIClient{
+		ControllerURL: server.URL,
+		HttpClient:    server.Client(),
+	}
+	controller := NewController(apiClient)
+	status, err := controller.GetStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsRunning() || status.Version != "1.40.0" {
+		t.Errorf("expected running controller 1.40.0, got %+v", status)
+	}
+}
+
+func TestCreateInstance_AdoptsInstanceCreatedByFailedAttempt(t *testing.T) {
+	const externalId = "https://gitlab.com/group/project/-/jobs/1"
+
+	var posts int32
+	var created bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			atomic.AddInt32(&posts, 1)
+			// the instance is created, but the connection drops before the response
+			created = true
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case http.MethodGet:
+			response := getAllInstancesResponse{response: response{Status: "OK"}, Instances: []InstanceWrapper{}}
+			if created {
+				response.Instances = append(response.Instances, InstanceWrapper{
+					Instance: &Instance{Id: "created-instance", ExternalId: externalId, State: StateScheduling},
+				})
+			}
+			json.NewEncoder(w).Encode(response)
+		}
+	}))
+	defer server.Close()
+
+	controller := NewController(newTestClient(server.URL, server.Client()))
+	instanceId, err := controller.CreateInstance(context.Background(), CreateInstanceRequest{TemplateId: "fake", ExternalId: externalId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceId != "created-instance" {
+		t.Errorf("expected instance created by the failed attempt to be adopted, got %q", instanceId)
+	}
+	if atomic.LoadInt32(&posts) != 1 {
+		t.Errorf("expected a single creation request, got %d", posts)
+	}
+}
+
+func TestCreateInstance_RetriesWhenNothingWasCreated(t *testing.T) {
+	var posts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			var payload CreateInstanceRequest
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.TemplateId != "fake" {
+				t.Errorf("expected the request body to be replayed, got %+v (%v)", payload, err)
+			}
+			if atomic.AddInt32(&posts, 1) == 1 {
+				w.WriteHeader(http.StatusGatewayTimeout)
+				return
+			}
+			json.NewEncoder(w).Encode(createInstanceResponse{response: response{Status: "OK"}, InstanceIds: []string{"new-instance"}})
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(getAllInstancesResponse{response: response{Status: "OK"}, Instances: []InstanceWrapper{}})
+		}
+	}))
+	defer server.Close()
+
+	controller := NewController(newTestClient(server.URL, server.Client()))
+	instanceId, err := controller.CreateInstance(context.Background(), CreateInstanceRequest{TemplateId: "fake", ExternalId: "https://gitlab.com/group/project/-/jobs/2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceId != "new-instance" || atomic.LoadInt32(&posts) != 2 {
+		t.Errorf("expected a second creation request, got instance %q after %d requests", instanceId, posts)
+	}
+}
+
+func TestGetInstancesByExternalId_FiltersInstances(t *testing.T) {
+	const externalId = "https://gitlab.com/group/project/-/jobs/3"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Query()) != 0 {
+			t.Errorf("expected no query parameters, got %s", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(getAllInstancesResponse{
+			response: response{Status: "OK"},
+			Instances: []InstanceWrapper{
+				{Instance: &Instance{Id: "job-instance", ExternalId: externalId, State: StateStarted}},
+				{Instance: &Instance{Id: "other-instance", ExternalId: "https://gitlab.com/group/project/-/jobs/4", State: StateStarted}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	controller := NewController(newTestClient(server.URL, server.Client()))
+	instances, err := controller.GetInstancesByExternalId(context.Background(), externalId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Id != "job-instance" {
+		t.Errorf("expected only the job's instance, got %+v", instances)
+	}
+}
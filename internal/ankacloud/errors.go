@@ -0,0 +1,72 @@
+package ankacloud
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Categories of controller failures, matched with errors.Is against an *APIError
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrCapacity     = errors.New("controller over capacity")
+	ErrBadRequest   = errors.New("bad request")
+	ErrServerError  = errors.New("controller server error")
+)
+
+// APIError is a request the controller answered with a failure
+type APIError struct {
+	// StatusCode is the HTTP status
+	StatusCode int
+	// Status and Message are the controller's own, if its response could be decoded
+	Status    string
+	Message   string
+	Method    string
+	Endpoint  string
+	RequestId string
+	// Err is set when the response could not be decoded
+	Err error
+}
+
+func (e *APIError) Error() string {
+	message := e.Message
+	if e.Err != nil {
+		message = e.Err.Error()
+	}
+	s := fmt.Sprintf("%s %s: status code: %d, error: %s", e.Method, e.Endpoint, e.StatusCode, message)
+	if e.RequestId != "" {
+		s += fmt.Sprintf(" (request id %s)", e.RequestId)
+	}
+	return s
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the error's category
+func (e *APIError) Is(target error) bool {
+	category := e.Category()
+	return category != nil && category == target
+}
+
+// Category returns the sentinel describing the failure, or nil if the status tells nothing more
+func (e *APIError) Category() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusForbidden:
+		return ErrForbidden
+	case e.StatusCode == http.StatusTooManyRequests, e.StatusCode == http.StatusServiceUnavailable:
+		return ErrCapacity
+	case e.StatusCode == http.StatusBadRequest, e.StatusCode == http.StatusUnprocessableEntity:
+		return ErrBadRequest
+	case e.StatusCode >= http.StatusInternalServerError:
+		return ErrServerError
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package ankacloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		category   error
+		message    string
+	}{
+		{"not found", http.StatusNotFound, `{"status":"FAIL","message":"no such template"}`, ErrNotFound, "no such template"},
+		{"unauthorized", http.StatusUnauthorized, `{"status":"FAIL","message":"authentication required"}`, ErrUnauthorized, "authentication required"},
+		{"forbidden", http.StatusForbidden, `{"status":"FAIL","message":"permission denied"}`, ErrForbidden, "permission denied"},
+		{"capacity", http.StatusTooManyRequests, `{"status":"FAIL","message":"too many requests"}`, ErrCapacity, "too many requests"},
+		{"bad request", http.StatusBadRequest, `{"status":"FAIL","message":"invalid vmid"}`, ErrBadRequest, "invalid vmid"},
+		{"server error", http.StatusInternalServerError, `<html>oops</html>`, ErrServerError, ""},
+		{"failure without HTTP status", http.StatusOK, `{"status":"FAIL","message":"something went wrong"}`, nil, "something went wrong"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(requestIdHeader) == "" {
+					t.Errorf("expected a request id header")
+				}
+				w.WriteHeader(tt.statusCode)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := newTestClient(server.URL, server.Client())
+			client.RetryConfig.MaxAttempts = 1
+			_, err := client.Get(context.Background(), "/api/v1/vm", map[string]string{"id": "fake"})
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected an APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tt.statusCode || apiErr.Message != tt.message || apiErr.Method != http.MethodGet || apiErr.Endpoint != "/api/v1/vm?id=fake" {
+				t.Errorf("unexpected APIError %+v", apiErr)
+			}
+			if apiErr.RequestId == "" {
+				t.Errorf("expected the request id to be reported")
+			}
+			if apiErr.Category() != tt.category {
+				t.Errorf("expected category %v, got %v", tt.category, apiErr.Category())
+			}
+			if tt.category != nil && !errors.Is(err, tt.category) {
+				t.Errorf("expected errors.Is(err, %v)", tt.category)
+			}
+		})
+	}
+}
+
+func TestGetTemplateIdByName_NotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(getTemplatesResponse{response: response{Status: statusOK}})
+	}))
+	defer server.Close()
+
+	controller := NewController(newTestClient(server.URL, server.Client()))
+	if _, err := controller.GetTemplateIdByName(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
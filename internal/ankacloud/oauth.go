@@ -0,0 +1,199 @@
+package ankacloud
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+const (
+	// tokens are refreshed this long before they expire, so they never expire mid-request
+	tokenExpirySkew = time.Minute
+
+	clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// OAuthConfig configures bearer token authentication toward an OAuth2 protected controller.
+// With a TokenURL, tokens are obtained with the client credentials grant, authenticating the client
+// with its secret and/or the Gitlab job's ID token as a JWT client assertion. Without a TokenURL,
+// the ID token itself is sent as the bearer token (federated auth).
+type OAuthConfig struct {
+	TokenURL         string
+	ClientId         string
+	ClientSecretPath string
+	Scopes           []string
+	IdToken          string
+}
+
+func (c OAuthConfig) Enabled() bool {
+	return c.TokenURL != "" || c.IdToken != ""
+}
+
+type oauthAuthenticator struct {
+	config       OAuthConfig
+	clientSecret string
+	httpClient   *http.Client
+	cache        *tokenCache
+
+	mu    sync.Mutex
+	token cachedToken
+}
+
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func newOAuthAuthenticator(config OAuthConfig, httpClient *http.Client, cacheDir string) (*oauthAuthenticator, error) {
+	a := &oauthAuthenticator{
+		config:     config,
+		httpClient: httpClient,
+	}
+
+	if config.ClientSecretPath != "" {
+		secret, err := os.ReadFile(config.ClientSecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OAuth client secret at %q: %w", config.ClientSecretPath, err)
+		}
+		a.clientSecret = strings.TrimSpace(string(secret))
+		log.RegisterSecret(a.clientSecret)
+	}
+
+	if config.TokenURL != "" {
+		if config.ClientId == "" {
+			return nil, fmt.Errorf("OAuth client id is required with a token URL")
+		}
+		if a.clientSecret == "" && config.IdToken == "" {
+			return nil, fmt.Errorf("OAuth client secret or ID token is required with a token URL")
+		}
+		// the ID token is part of the key, so job scoped tokens are never shared between jobs
+		cacheKey := strings.Join([]string{"oauth", config.TokenURL, config.ClientId, strings.Join(config.Scopes, " "), config.IdToken}, "|")
+		a.cache = newTokenCache(cacheDir, cacheKey)
+	}
+
+	return a, nil
+}
+
+func (a *oauthAuthenticator) Authorize(ctx context.Context, req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.config.TokenURL == "" {
+		// the ID token cannot be refreshed, it lives as long as the job
+		if expiry, ok := jwtExpiry(a.config.IdToken); ok && !time.Now().Before(expiry) {
+			return fmt.Errorf("job ID token expired at %s", expiry.Format(time.RFC3339))
+		}
+		log.RegisterSecret(a.config.IdToken)
+		req.Header.Set("Authorization", "Bearer "+a.config.IdToken)
+		return nil
+	}
+
+	now := time.Now()
+	if !a.token.valid(now, tokenExpirySkew) {
+		a.token = a.cache.load()
+	}
+
+	if !a.token.valid(now, tokenExpirySkew) {
+		token, err := a.requestToken(ctx)
+		if err != nil {
+			return err
+		}
+		a.token = token
+		a.cache.store(a.token)
+	}
+
+	log.RegisterSecret(a.token.Token)
+	req.Header.Set("Authorization", "Bearer "+a.token.Token)
+	return nil
+}
+
+func (a *oauthAuthenticator) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.token = cachedToken{}
+	a.cache.clear()
+}
+
+func (a *oauthAuthenticator) requestToken(ctx context.Context) (cachedToken, error) {
+	log.Debugf("requesting OAuth token from %s\n", a.config.TokenURL)
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(a.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.config.Scopes, " "))
+	}
+	if a.config.IdToken != "" {
+		form.Set("client_id", a.config.ClientId)
+		form.Set("client_assertion_type", clientAssertionTypeJWTBearer)
+		form.Set("client_assertion", a.config.IdToken)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return cachedToken{}, fmt.Errorf("failed to create token request to %q: %w", a.config.TokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(a.config.ClientId), url.QueryEscape(a.clientSecret))
+	}
+
+	r, err := a.httpClient.Do(req)
+	if err != nil {
+		return cachedToken{}, fmt.Errorf("failed to send token request to %s: %w", a.config.TokenURL, err)
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return cachedToken{}, fmt.Errorf("failed to read token response body: %w", err)
+	}
+
+	var response oauthTokenResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return cachedToken{}, fmt.Errorf("status code: %d, failed to decode token response: %w", r.StatusCode, err)
+	}
+	if r.StatusCode != http.StatusOK || response.AccessToken == "" {
+		return cachedToken{}, fmt.Errorf("status code: %d, error: %s %s", r.StatusCode, response.Error, response.ErrorDescription)
+	}
+
+	token := cachedToken{Token: response.AccessToken}
+	if response.ExpiresIn > 0 {
+		token.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// jwtExpiry returns the expiry (exp claim) of a JWT, without verifying it
+func jwtExpiry(jwt string) (time.Time, bool) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,138 @@
+package ankacloud
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOAuthClientCredentials(t *testing.T) {
+	const (
+		clientId     = "fake-client"
+		clientSecret = "fake-secret"
+	)
+
+	var issued int
+	expiresIn := 3600
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			id, secret, ok := r.BasicAuth()
+			if !ok || id != clientId || secret != clientSecret {
+				t.Errorf("expected client credentials %q:%q, got %q:%q", clientId, clientSecret, id, secret)
+			}
+			r.ParseForm()
+			if grant := r.PostForm.Get("grant_type"); grant != "client_credentials" {
+				t.Errorf("expected client_credentials grant, got %q", grant)
+			}
+			if scope := r.PostForm.Get("scope"); scope != "anka.read anka.write" {
+				t.Errorf("expected scopes to be space separated, got %q", scope)
+			}
+			issued++
+			json.NewEncoder(w).Encode(oauthTokenResponse{AccessToken: fmt.Sprintf("token-%d", issued), TokenType: "Bearer", ExpiresIn: expiresIn})
+			return
+		}
+
+		if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", issued) {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(response{Status: "FAIL", Message: "unauthorized"})
+			return
+		}
+		json.NewEncoder(w).Encode(response{Status: statusOK})
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretPath, []byte(clientSecret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := APIClientConfig{
+		BaseURL: server.URL,
+		OAuth: OAuthConfig{
+			TokenURL:         server.URL + "/token",
+			ClientId:         clientId,
+			ClientSecretPath: secretPath,
+			Scopes:           []string{"anka.read", "anka.write"},
+		},
+		TokenCacheDir: filepath.Join(dir, "tokens"),
+	}
+
+	client, err := NewAPIClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(context.Background(), "/api/v1/vm", map[string]string{"id": "fake"}); err != nil {
+		t.Fatal(err)
+	}
+	if issued != 1 {
+		t.Errorf("expected a single token to be issued, got %d", issued)
+	}
+
+	// a new client, like the next stage process, reuses the cached token
+	client, err = NewAPIClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err != nil {
+		t.Fatal(err)
+	}
+	if issued != 1 {
+		t.Errorf("expected cached token to be reused, got %d tokens issued", issued)
+	}
+
+	// tokens about to expire are refreshed before they are used
+	expiresIn = 30
+	os.RemoveAll(config.TokenCacheDir)
+	client, err = NewAPIClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if issued != 3 {
+		t.Errorf("expected token expiring within the skew to be refreshed, got %d tokens issued", issued)
+	}
+}
+
+func TestOAuthIdTokenAsBearer(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(-time.Minute).Unix())))
+	expired := "header." + payload + ".signature"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fake-id-token" {
+			t.Errorf("expected the ID token as bearer token, got %q", r.Header.Get("Authorization"))
+		}
+		json.NewEncoder(w).Encode(response{Status: statusOK})
+	}))
+	defer server.Close()
+
+	client, err := NewAPIClient(APIClientConfig{BaseURL: server.URL, OAuth: OAuthConfig{IdToken: "fake-id-token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = NewAPIClient(APIClientConfig{BaseURL: server.URL, OAuth: OAuthConfig{IdToken: expired}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err == nil {
+		t.Errorf("expected an error for an expired ID token")
+	}
+}
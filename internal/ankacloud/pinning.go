@@ -0,0 +1,137 @@
+package ankacloud
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+// spkiHash is the SHA-256 of the certificate's SubjectPublicKeyInfo, the value pinned by curl --pinnedpubkey and HPKP
+func spkiHash(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// parsePins decodes SPKI SHA-256 pins, in base64 with an optional "sha256//" prefix, or in hex
+func parsePins(pins []string) ([][sha256.Size]byte, error) {
+	var hashes [][sha256.Size]byte
+	for _, pin := range pins {
+		value := strings.TrimSpace(pin)
+		value = strings.TrimPrefix(value, "sha256//")
+		value = strings.TrimPrefix(value, "sha256/")
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(decoded) != sha256.Size {
+			decoded, err = hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+		}
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI SHA-256 pin %q", pin)
+		}
+		hashes = append(hashes, [sha256.Size]byte(decoded))
+	}
+	return hashes, nil
+}
+
+// verifyPeerCertificate checks the controller's certificate chain against the pins, and warns when its
+// certificates expire soon. Any pin matching any certificate of the chain passes, so the next key can be
+// pinned next to the current one ahead of a rotation.
+func verifyPeerCertificate(pins [][sha256.Size]byte, expiryWarning time.Duration) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		chains := verifiedChains
+		// without verification (skip TLS verify), only the leaf proved to be the controller's, by the handshake.
+		// The other certificates it sent are anyone's to append, so they only count once the leaf chains up to them.
+		if len(chains) == 0 {
+			var certs []*x509.Certificate
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("failed to parse controller certificate: %w", err)
+				}
+				certs = append(certs, cert)
+			}
+			chains = pinnedChains(pins, certs)
+			if len(chains) == 0 {
+				chains = [][]*x509.Certificate{certs[:min(len(certs), 1)]}
+			}
+		}
+
+		if expiryWarning > 0 && len(chains[0]) > 0 {
+			warnIfExpiring(chains[0][0], "controller", expiryWarning)
+		}
+
+		if len(pins) == 0 {
+			return nil
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				hash := spkiHash(cert)
+				for _, pin := range pins {
+					if hash == pin {
+						log.HTTP.Debugf("controller certificate chain matches pin sha256//%s of %q\n", base64.StdEncoding.EncodeToString(pin[:]), cert.Subject)
+						return nil
+					}
+				}
+			}
+		}
+
+		if len(chains[0]) == 0 {
+			return fmt.Errorf("controller sent no certificate to match the configured pins")
+		}
+		leaf := chains[0][0]
+		hash := spkiHash(leaf)
+		return fmt.Errorf("controller certificate %s (pin sha256//%s) matches none of the configured pins", describeCertificate(leaf), base64.StdEncoding.EncodeToString(hash[:]))
+	}
+}
+
+// pinnedChains verifies the leaf against the pinned certificates the controller sent along with it, as roots.
+// The host name is not checked, skipping TLS verify allows a controller certificate for another name.
+func pinnedChains(pins [][sha256.Size]byte, certs []*x509.Certificate) [][]*x509.Certificate {
+	if len(certs) < 2 {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	pinned := false
+	for _, cert := range certs[1:] {
+		if slices.Contains(pins, spkiHash(cert)) {
+			roots.AddCert(cert)
+			pinned = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if !pinned {
+		return nil
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		log.HTTP.Debugf("controller certificate %s does not chain up to the pinned certificates it was sent with: %s\n", describeCertificate(certs[0]), err)
+		return nil
+	}
+	return chains
+}
+
+// warned keeps a certificate's expiry from being warned about on every connection
+var warned sync.Map
+
+func warnIfExpiring(cert *x509.Certificate, what string, within time.Duration) {
+	left := time.Until(cert.NotAfter)
+	if left > within || left < 0 {
+		return
+	}
+	if _, done := warned.LoadOrStore(string(cert.Raw), true); done {
+		return
+	}
+	log.Warnf("%s certificate %s expires in %d days\n", what, describeCertificate(cert), int(left.Hours()/24))
+}
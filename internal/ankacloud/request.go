@@ -0,0 +1,293 @@
+package ankacloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
+)
+
+// Handler sends a controller request. The response body it returns is fully buffered.
+type Handler func(req *http.Request) (*http.Response, error)
+
+// Middleware wraps a Handler, to add headers, credentials, logging, retries etc.
+type Middleware func(next Handler) Handler
+
+const requestIdHeader = "X-Request-Id"
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type idempotentKey struct{}
+
+// WithIdempotent marks the requests sent with ctx as safe to repeat (or not), overriding the
+// default rule that GET, PUT and DELETE requests are idempotent and POST requests are not.
+func WithIdempotent(ctx context.Context, idempotent bool) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, idempotent)
+}
+
+func isIdempotent(req *http.Request) bool {
+	if idempotent, ok := req.Context().Value(idempotentKey{}).(bool); ok {
+		return idempotent
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Use adds middleware to the request pipeline. It runs inside the retries, so once per attempt.
+func (c *APIClient) Use(middleware ...Middleware) {
+	c.Middlewares = append(c.Middlewares, middleware...)
+}
+
+// handler chains the pipeline: retry -> custom middleware -> headers -> auth -> tracing -> logging -> transport
+func (c *APIClient) handler() Handler {
+	handler := c.transport
+	chain := []Middleware{c.retryMiddleware}
+	chain = append(chain, c.Middlewares...)
+	chain = append(chain, c.headersMiddleware, c.authMiddleware, tracingMiddleware, loggingMiddleware)
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler
+}
+
+// transport sends the request and buffers the response body, so a connection dropped
+// while reading the body is seen (and retried) like any other failed attempt
+func (c *APIClient) transport(req *http.Request) (*http.Response, error) {
+	r, err := c.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return r, nil
+}
+
+func (c *APIClient) headersMiddleware(next Handler) Handler {
+	return func(req *http.Request) (*http.Response, error) {
+		for k, v := range c.CustomHttpHeaders {
+			log.HTTP.Debugf("Setting custom header %s\n", k)
+			req.Header.Set(k, v)
+		}
+		return next(req)
+	}
+}
+
+// authMiddleware adds the credentials. If the controller rejects them, they are refreshed and the request is sent once more.
+func (c *APIClient) authMiddleware(next Handler) Handler {
+	return func(req *http.Request) (*http.Response, error) {
+		if c.Authenticator == nil {
+			return next(req)
+		}
+
+		if err := c.Authenticator.Authorize(req.Context(), req); err != nil {
+			return nil, fmt.Errorf("failed to authenticate with controller: %w", err)
+		}
+
+		r, err := next(req)
+		if err != nil || r.StatusCode != http.StatusUnauthorized {
+			return r, err
+		}
+
+		log.HTTP.Debugf("controller rejected credentials for %s %s, refreshing them\n", req.Method, req.URL.Path)
+		c.Authenticator.Invalidate()
+
+		retryReq, err := cloneRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Authenticator.Authorize(retryReq.Context(), retryReq); err != nil {
+			return nil, fmt.Errorf("failed to authenticate with controller: %w", err)
+		}
+		return next(retryReq)
+	}
+}
+
+// tracingMiddleware records a span per attempt, and passes its trace context to the controller
+func tracingMiddleware(next Handler) Handler {
+	return func(req *http.Request) (*http.Response, error) {
+		ctx, span := tracing.Start(req.Context(), req.Method+" "+req.URL.Path, tracing.KindClient)
+		if span == nil {
+			return next(req)
+		}
+		defer span.End()
+		span.SetAttribute("http.request.method", req.Method)
+		span.SetAttribute("url.path", req.URL.Path)
+		span.SetAttribute("server.address", req.URL.Host)
+
+		req = req.WithContext(ctx)
+		req.Header.Set("traceparent", tracing.Traceparent(ctx))
+		r, err := next(req)
+		if err != nil {
+			span.SetError(err)
+			return r, err
+		}
+		span.SetAttribute("http.response.status_code", r.StatusCode)
+		if r.StatusCode >= http.StatusBadRequest {
+			span.SetError(fmt.Errorf("status code %d", r.StatusCode))
+		}
+		return r, err
+	}
+}
+
+func loggingMiddleware(next Handler) Handler {
+	return func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		r, err := next(req)
+		if err != nil {
+			log.HTTP.Debugf("%s %s failed after %s: %s\n", req.Method, req.URL.Path, time.Since(start), err)
+			return r, err
+		}
+		log.HTTP.Debugf("%s %s responded %d in %s\n", req.Method, req.URL.Path, r.StatusCode, time.Since(start))
+		return r, err
+	}
+}
+
+// retryMiddleware resends requests that failed for reasons worth another try, with exponential backoff
+func (c *APIClient) retryMiddleware(next Handler) Handler {
+	return func(req *http.Request) (*http.Response, error) {
+		config := c.RetryConfig
+		if config.MaxAttempts < 1 {
+			config = DefaultRetryConfig()
+		}
+		delay := config.InitialDelay
+
+		for attempt := 1; ; attempt++ {
+			r, err := next(req)
+
+			wait, retry := shouldRetry(req, r, err)
+			if !retry || attempt >= config.MaxAttempts {
+				return r, err
+			}
+			if wait < delay {
+				wait = delay
+			}
+			// a longer Retry-After is cut like the backoff: the attempts left may still get through
+			if wait > config.MaxDelay {
+				wait = config.MaxDelay
+			}
+
+			reason := "request failed"
+			if err == nil {
+				reason = fmt.Sprintf("controller responded %d", r.StatusCode)
+			}
+			log.Printf("%s %s %s (attempt %d/%d), retrying in %v...\n", req.Method, req.URL.Path, reason, attempt, config.MaxAttempts, wait)
+
+			select {
+			case <-req.Context().Done():
+				if err == nil {
+					return r, nil
+				}
+				return nil, err
+			case <-time.After(wait):
+			}
+
+			delay *= 2
+			if delay > config.MaxDelay {
+				delay = config.MaxDelay
+			}
+
+			if req, err = cloneRequest(req); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// shouldRetry applies the retry policy. Failures that prove the controller never handled the request
+// (refused connections, 429, 503) are retried for every request; failures that leave it unknown
+// (resets, timeouts, 502, 504) only for idempotent requests. It also returns how long the controller asked to wait.
+func shouldRetry(req *http.Request, r *http.Response, err error) (time.Duration, bool) {
+	if req.Context().Err() != nil {
+		return 0, false
+	}
+
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return 0, true
+		}
+		return 0, isIdempotent(req) && isConnectionError(err)
+	}
+
+	switch r.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return retryAfter(r), true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return retryAfter(r), isIdempotent(req)
+	}
+	return 0, false
+}
+
+// isOutcomeUnknown tells if a failed request may still have been carried out by the controller,
+// like a connection dropped before the response, or a gateway giving up on a slow controller
+func isOutcomeUnknown(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusBadGateway || apiErr.StatusCode == http.StatusGatewayTimeout
+	}
+	return isConnectionError(err)
+}
+
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryAfter parses the Retry-After header, in seconds or as an HTTP date
+func retryAfter(r *http.Response) time.Duration {
+	value := r.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// cloneRequest copies the request with a fresh body, so it can be sent again
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay request body: %w", err)
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
@@ -0,0 +1,191 @@
+package ankacloud
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
+)
+
+func newTestClient(serverURL string, client *http.Client) *APIClient {
+	return &APIClient{
+		ControllerURL: serverURL,
+		HttpClient:    client,
+		RetryConfig: RetryConfig{
+			MaxAttempts:  3,
+			InitialDelay: time.Millisecond,
+			MaxDelay:     10 * time.Millisecond,
+		},
+	}
+}
+
+func TestRetry_ServiceUnavailableReplaysBody(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"id":"fake"}` {
+			t.Errorf("expected request body to be replayed, got %q", body)
+		}
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(response{Status: statusOK})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL, server.Client())
+	if _, err := client.Post(context.Background(), "/api/v1/vm", map[string]string{"id": "fake"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
+
+func TestRetry_BadGatewayOnlyForIdempotentRequests(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL, server.Client())
+
+	if _, err := client.Post(context.Background(), "/api/v1/vm", nil); err == nil {
+		t.Errorf("expected error")
+	}
+	if calls != 1 {
+		t.Errorf("expected POST not to be retried on 502, got %d calls", calls)
+	}
+
+	calls = 0
+	if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err == nil {
+		t.Errorf("expected error")
+	}
+	if calls != 3 {
+		t.Errorf("expected GET to be attempted 3 times on 502, got %d calls", calls)
+	}
+
+	calls = 0
+	ctx := WithIdempotent(context.Background(), true)
+	if _, err := client.Post(ctx, "/api/v1/vm", nil); err == nil {
+		t.Errorf("expected error")
+	}
+	if calls != 3 {
+		t.Errorf("expected POST marked idempotent to be attempted 3 times, got %d calls", calls)
+	}
+}
+
+func TestRetry_ConnectionReset(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// drop the connection without a response
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		json.NewEncoder(w).Encode(response{Status: statusOK})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL, server.Client())
+	if _, err := client.Delete(context.Background(), "/api/v1/vm", map[string]string{"id": "fake"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected dropped DELETE to be retried, got %d calls", calls)
+	}
+}
+
+func TestRetry_TooManyRequestsRetryAfter(t *testing.T) {
+	if d := retryAfter(&http.Response{Header: http.Header{"Retry-After": {"7"}}}); d != 7*time.Second {
+		t.Errorf("expected 7s, got %s", d)
+	}
+
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL, server.Client())
+	start := time.Now()
+	if _, err := client.Post(context.Background(), "/api/v1/vm", nil); err == nil {
+		t.Errorf("expected error")
+	}
+	if calls != 3 {
+		t.Errorf("expected 429 to be retried, got %d calls", calls)
+	}
+	// Retry-After is capped by the max delay
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Retry-After to be capped, took %s", elapsed)
+	}
+}
+
+func TestMiddlewareRunsPerAttempt(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("X-Attempt") == "" {
+			t.Errorf("expected middleware header")
+		}
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(response{Status: statusOK})
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL, server.Client())
+	var attempts int
+	client.Use(func(next Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			attempts++
+			req.Header.Set("X-Attempt", "set")
+			return next(req)
+		}
+	})
+	if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected middleware to run on both attempts, got %d", attempts)
+	}
+}
+
+func TestTraceparentPropagation(t *testing.T) {
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		json.NewEncoder(w).Encode(response{Status: statusOK})
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	ctx := tracing.Init(context.Background(), tracing.Config{File: filepath.Join(dir, "traces.jsonl"), Dir: dir}, "fake-job-url", "prepare")
+	defer tracing.Flush(context.Background(), nil)
+
+	client := newTestClient(server.URL, server.Client())
+	if _, err := client.Get(ctx, "/api/v1/status", nil); err != nil {
+		t.Fatal(err)
+	}
+	parent := tracing.Traceparent(ctx)
+	if len(traceparent) != len(parent) || traceparent[:35] != parent[:35] || traceparent == parent {
+		t.Errorf("expected traceparent of a child span of %q, got %q", parent, traceparent)
+	}
+}
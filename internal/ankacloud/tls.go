@@ -1,18 +1,36 @@
 package ankacloud
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
+const defaultTLSMinVersion = tls.VersionTLS12
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 func configureTLS(config APIClientConfig) (*tls.Config, error) {
-	log.Debugln("handling TLS configuration")
+	log.HTTP.Debugf("handling TLS configuration\n")
 
-	tlsConfig := &tls.Config{}
+	tlsConfig := &tls.Config{
+		MinVersion: defaultTLSMinVersion,
+	}
 	caCertPool, _ := x509.SystemCertPool()
 	if caCertPool == nil {
 		caCertPool = x509.NewCertPool()
@@ -23,23 +41,61 @@ func configureTLS(config APIClientConfig) (*tls.Config, error) {
 		if err := appendRootCert(config.CaCertPath, caCertPool); err != nil {
 			return nil, fmt.Errorf("failed to add CA cert from %q to pool: %w", config.CaCertPath, err)
 		}
-		log.ConditionalColorf("using CA cert from %q\n", config.CaCertPath)
+		log.HTTP.Colorf("using CA cert from %q\n", config.CaCertPath)
+	}
+
+	if config.CaCertPEM != "" {
+		if err := appendRootCertsPEM([]byte(config.CaCertPEM), caCertPool); err != nil {
+			return nil, fmt.Errorf("failed to add inline CA cert to pool: %w", err)
+		}
+		log.HTTP.Colorf("using inline CA cert\n")
 	}
 
 	if config.SkipTLSVerify {
-		log.ConditionalColorf("allowing to skip server host verification")
+		log.HTTP.Colorf("allowing to skip server host verification")
 		tlsConfig.InsecureSkipVerify = true
 	}
 
-	if config.certAuthEnabled() {
-		cert, err := tls.LoadX509KeyPair(config.ClientCertPath, config.ClientCertKeyPath)
+	if config.TLSMinVersion != "" {
+		version, ok := tlsVersions[config.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version %q", config.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(config.TLSCipherSuites) > 0 {
+		suites, err := parseCipherSuites(config.TLSCipherSuites)
 		if err != nil {
-			return nil, fmt.Errorf("failed to process key pair (cert at %q, key at %q): %w", config.ClientCertPath, config.ClientCertKeyPath, err)
+			return nil, err
 		}
+		// TLS 1.3 suites are not configurable, this only restricts older versions
+		tlsConfig.CipherSuites = suites
+	}
 
+	if config.certAuthEnabled() {
+		cert, err := loadClientCertificate(config)
+		if err != nil {
+			return nil, err
+		}
+		log.HTTP.Debugf("using client certificate %s\n", describeCertificate(cert.Leaf))
+		if config.CertExpiryWarning > 0 {
+			warnIfExpiring(cert.Leaf, "client", config.CertExpiryWarning)
+		}
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
+	if len(config.TLSPins) > 0 || config.CertExpiryWarning > 0 {
+		pins, err := parsePins(config.TLSPins)
+		if err != nil {
+			return nil, err
+		}
+		if len(pins) > 0 {
+			log.HTTP.Colorf("pinning controller certificate to %d public key(s)\n", len(pins))
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPeerCertificate(pins, config.CertExpiryWarning)
+	}
+
 	return tlsConfig, nil
 }
 
@@ -48,9 +104,219 @@ func appendRootCert(certFilePath string, caCertPool *x509.CertPool) error {
 	if err != nil {
 		return fmt.Errorf("failed to read file at %q: %w", certFilePath, err)
 	}
-	ok := caCertPool.AppendCertsFromPEM(cert)
-	if !ok {
-		return fmt.Errorf("failed to add cert at %q to cert pool: %w", certFilePath, err)
+	return appendRootCertsPEM(cert, caCertPool)
+}
+
+func appendRootCertsPEM(data []byte, caCertPool *x509.CertPool) error {
+	certs, err := parseCertificatesPEM(data)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, cert := range certs {
+		if now.After(cert.NotAfter) {
+			log.Warnf("CA certificate %s has expired\n", describeCertificate(cert))
+		}
+		caCertPool.AddCert(cert)
 	}
 	return nil
 }
+
+func parseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return certs, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			if insecure[name] {
+				return nil, fmt.Errorf("cipher suite %s is insecure", name)
+			}
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadClientCertificate loads the client certificate from a PKCS#12 bundle, or from PEM files or
+// inline PEM, decrypting encrypted PKCS#8 keys with the passphrase
+func loadClientCertificate(config APIClientConfig) (tls.Certificate, error) {
+	var passphrase string
+	if config.ClientCertPassphrasePath != "" {
+		data, err := os.ReadFile(config.ClientCertPassphrasePath)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to read client certificate passphrase at %q: %w", config.ClientCertPassphrasePath, err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+		log.RegisterSecret(passphrase)
+	}
+
+	var certPEM, keyPEM []byte
+	var source string
+	if config.ClientCertP12Path != "" {
+		source = fmt.Sprintf("PKCS#12 bundle at %q", config.ClientCertP12Path)
+		data, err := os.ReadFile(config.ClientCertP12Path)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to read %s: %w", source, err)
+		}
+		certPEM, keyPEM, err = pkcs12ToPEM(data, passphrase)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to decode %s: %w", source, err)
+		}
+	} else {
+		var err error
+		if certPEM, source, err = readPEM(config.ClientCertPath, config.ClientCertPEM, "client certificate"); err != nil {
+			return tls.Certificate{}, err
+		}
+		if keyPEM, _, err = readPEM(config.ClientCertKeyPath, config.ClientCertKeyPEM, "client certificate key"); err != nil {
+			return tls.Certificate{}, err
+		}
+		if keyPEM, err = decryptKeyPEM(keyPEM, passphrase); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to decrypt client certificate key: %w", err)
+		}
+	}
+
+	// describe the certificate in errors, so the culprit is easy to find among rotated certificates
+	description := source
+	if certs, err := parseCertificatesPEM(certPEM); err == nil {
+		description = describeCertificate(certs[0])
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to process key pair of client certificate %s: %w", description, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to parse client certificate %s: %w", description, err)
+		}
+	}
+
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) {
+		return tls.Certificate{}, fmt.Errorf("client certificate %s has expired", description)
+	}
+	if now.Before(cert.Leaf.NotBefore) {
+		return tls.Certificate{}, fmt.Errorf("client certificate %s is not valid before %s", description, cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	return cert, nil
+}
+
+// readPEM returns the inline PEM, or else the contents of the file at path
+func readPEM(path string, inline string, what string) ([]byte, string, error) {
+	if inline != "" {
+		return []byte(inline), "inline " + what, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s at %q: %w", what, path, err)
+	}
+	return data, fmt.Sprintf("%s at %q", what, path), nil
+}
+
+// pkcs12ToPEM extracts the key and certificates of a PKCS#12 bundle, with the certificate of the key first.
+// Both the legacy (RC2, 3DES) and the PBES2/AES encryption of OpenSSL 3 are supported.
+func pkcs12ToPEM(data []byte, passphrase string) ([]byte, []byte, error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode the bundle's key: %w", err)
+	}
+
+	var certPEM bytes.Buffer
+	for _, c := range append([]*x509.Certificate{cert}, caCerts...) {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return certPEM.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// decryptKeyPEM replaces an "ENCRYPTED PRIVATE KEY" (PKCS#8) block by its decrypted key
+func decryptKeyPEM(data []byte, passphrase string) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		return data, nil
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("key is encrypted, but no passphrase is configured")
+	}
+
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(passphrase))
+	if err != nil {
+		if strings.Contains(err.Error(), "incorrect password") {
+			return nil, fmt.Errorf("wrong passphrase")
+		}
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// describeCertificate names a certificate by its subject and expiry
+func describeCertificate(cert *x509.Certificate) string {
+	if cert == nil {
+		return "(none)"
+	}
+	return fmt.Sprintf("%q (issued by %q, expires %s)", cert.Subject.String(), cert.Issuer.String(), cert.NotAfter.Format(time.RFC3339))
+}
+
+// describeTLSError adds the subject and expiry of the controller certificate to certificate verification errors
+func describeTLSError(err error) error {
+	var cert *x509.Certificate
+
+	var verificationErr *tls.CertificateVerificationError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.As(err, &verificationErr) && len(verificationErr.UnverifiedCertificates) > 0:
+		cert = verificationErr.UnverifiedCertificates[0]
+	case errors.As(err, &invalidErr):
+		cert = invalidErr.Cert
+	case errors.As(err, &authorityErr):
+		cert = authorityErr.Cert
+	case errors.As(err, &hostnameErr):
+		cert = hostnameErr.Certificate
+	}
+	if cert == nil {
+		return err
+	}
+	return fmt.Errorf("%w: controller certificate %s", err, describeCertificate(cert))
+}
@@ -0,0 +1,378 @@
+package ankacloud
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/youmark/pkcs8"
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func generateCert(t *testing.T, commonName string, notAfter time.Time) (certPEM []byte, keyDER []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notAfter.Add(-30 * 24 * time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err = x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyDER
+}
+
+// encryptPKCS8 encrypts like `openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256`
+func encryptPKCS8(t *testing.T, keyDER []byte, passphrase string) []byte {
+	t.Helper()
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := pkcs8.MarshalPrivateKey(key, []byte(passphrase), &pkcs8.Opts{
+		Cipher:  pkcs8.AES256CBC,
+		KDFOpts: pkcs8.PBKDF2Opts{SaltSize: 8, IterationCount: 2048, HMACHash: crypto.SHA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der})
+}
+
+func TestInlinePEMClientCertificate(t *testing.T) {
+	certPEM, keyDER := generateCert(t, "runner-1", time.Now().Add(24*time.Hour))
+
+	tlsConfig, err := configureTLS(APIClientConfig{
+		CaCertPEM:        string(certPEM),
+		ClientCertPEM:    string(certPEM),
+		ClientCertKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConfig.Certificates) != 1 || tlsConfig.Certificates[0].Leaf.Subject.CommonName != "runner-1" {
+		t.Errorf("expected client certificate of runner-1, got %+v", tlsConfig.Certificates)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 minimum by default, got %x", tlsConfig.MinVersion)
+	}
+}
+
+func TestEncryptedPKCS8Key(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyDER := generateCert(t, "runner-1", time.Now().Add(24*time.Hour))
+	passphrasePath := filepath.Join(dir, "passphrase")
+	os.WriteFile(passphrasePath, []byte("correct horse\n"), 0600)
+
+	config := APIClientConfig{
+		ClientCertPEM:            string(certPEM),
+		ClientCertKeyPEM:         string(encryptPKCS8(t, keyDER, "correct horse")),
+		ClientCertPassphrasePath: passphrasePath,
+	}
+	if _, err := configureTLS(config); err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(passphrasePath, []byte("wrong"), 0600)
+	_, err := configureTLS(config)
+	if err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("expected wrong passphrase error, got %v", err)
+	}
+
+	config.ClientCertPassphrasePath = ""
+	if _, err := configureTLS(config); err == nil {
+		t.Error("expected error without passphrase")
+	}
+}
+
+func TestPKCS12ClientCertificate(t *testing.T) {
+	certPEM, keyDER := generateCert(t, "runner-1", time.Now().Add(24*time.Hour))
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoders := map[string]*gopkcs12.Encoder{
+		// what `openssl pkcs12 -export` writes by default since OpenSSL 3
+		"modern": gopkcs12.Modern,
+		"legacy": gopkcs12.LegacyDES,
+	}
+	for name, encoder := range encoders {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			bundle, err := encoder.Encode(key, cert, nil, "correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bundlePath := filepath.Join(dir, "client.p12")
+			passphrasePath := filepath.Join(dir, "passphrase")
+			os.WriteFile(bundlePath, bundle, 0600)
+			os.WriteFile(passphrasePath, []byte("correct horse\n"), 0600)
+
+			tlsConfig, err := configureTLS(APIClientConfig{ClientCertP12Path: bundlePath, ClientCertPassphrasePath: passphrasePath})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tlsConfig.Certificates) != 1 || tlsConfig.Certificates[0].Leaf.Subject.CommonName != "runner-1" {
+				t.Errorf("expected client certificate of runner-1, got %+v", tlsConfig.Certificates)
+			}
+
+			os.WriteFile(passphrasePath, []byte("wrong"), 0600)
+			if _, err := configureTLS(APIClientConfig{ClientCertP12Path: bundlePath, ClientCertPassphrasePath: passphrasePath}); err == nil {
+				t.Error("expected error with the wrong passphrase")
+			}
+		})
+	}
+}
+
+func TestExpiredClientCertificate(t *testing.T) {
+	notAfter := time.Now().Add(-time.Hour).Truncate(time.Second)
+	certPEM, keyDER := generateCert(t, "old-runner", notAfter)
+
+	_, err := configureTLS(APIClientConfig{
+		ClientCertPEM:    string(certPEM),
+		ClientCertKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	})
+	if err == nil {
+		t.Fatal("expected error for expired certificate")
+	}
+	for _, expected := range []string{"CN=old-runner", notAfter.UTC().Format(time.RFC3339), "expired"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q, got %q", expected, err)
+		}
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	tlsConfig, err := configureTLS(APIClientConfig{
+		TLSMinVersion:   "1.3",
+		TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3 minimum, got %x", tlsConfig.MinVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("unexpected cipher suites %v", tlsConfig.CipherSuites)
+	}
+
+	if _, err := configureTLS(APIClientConfig{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}); err == nil || !strings.Contains(err.Error(), "insecure") {
+		t.Errorf("expected insecure cipher suite error, got %v", err)
+	}
+	if _, err := configureTLS(APIClientConfig{TLSMinVersion: "2.0"}); err == nil {
+		t.Error("expected unsupported TLS version error")
+	}
+}
+
+func TestServerCertificateErrorDescribesCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client, err := NewAPIClient(APIClientConfig{BaseURL: server.URL, IsTLS: true, Retry: RetryConfig{MaxAttempts: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get(context.Background(), "/api/v1/status", nil)
+	if err == nil || !strings.Contains(err.Error(), "controller certificate \"O=Acme Co\"") || !strings.Contains(err.Error(), "expires") {
+		t.Errorf("expected error describing the controller certificate, got %v", err)
+	}
+}
+
+func TestCertificatePinning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "OK", "body": {"status": "Running"}}`))
+	}))
+	defer server.Close()
+
+	leaf := server.Certificate()
+	hash := spkiHash(leaf)
+	pin := "sha256//" + base64.StdEncoding.EncodeToString(hash[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}))
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{"matching pin", []string{pin}, false},
+		{"rotation to a new key", []string{otherPin, pin}, false},
+		{"hex pin", []string{hex.EncodeToString(hash[:])}, false},
+		{"no matching pin", []string{otherPin}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewAPIClient(APIClientConfig{
+				BaseURL:   server.URL,
+				IsTLS:     true,
+				CaCertPEM: caPEM,
+				TLSPins:   tt.pins,
+				Retry:     RetryConfig{MaxAttempts: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Get(context.Background(), "/api/v1/status", nil)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "matches none of the configured pins") {
+				t.Errorf("expected pin mismatch error, got %v", err)
+			}
+		})
+	}
+
+	if _, err := parsePins([]string{"not-a-pin"}); err == nil {
+		t.Error("expected invalid pin error")
+	}
+}
+
+// issueCert creates a server certificate for 127.0.0.1, self-signed if parent is nil
+func issueCert(t *testing.T, commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestCertificatePinningWithoutVerification(t *testing.T) {
+	ca, caKey := issueCert(t, "pinned-ca", true, nil, nil)
+	genuine, genuineKey := issueCert(t, "controller", false, ca, caKey)
+	attacker, attackerKey := issueCert(t, "attacker", false, nil, nil)
+	caHash := spkiHash(ca)
+	genuineHash := spkiHash(genuine)
+
+	tests := []struct {
+		name    string
+		chain   []*x509.Certificate
+		key     *ecdsa.PrivateKey
+		pin     [sha256.Size]byte
+		wantErr bool
+	}{
+		{"pinned leaf", []*x509.Certificate{genuine, ca}, genuineKey, genuineHash, false},
+		{"leaf issued by pinned CA", []*x509.Certificate{genuine, ca}, genuineKey, caHash, false},
+		{"pinned CA appended to another leaf", []*x509.Certificate{attacker, ca}, attackerKey, caHash, true},
+		{"pinned leaf appended to another leaf", []*x509.Certificate{attacker, genuine}, attackerKey, genuineHash, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"status": "OK", "body": {"status": "Running"}}`))
+			}))
+			var certificate tls.Certificate
+			for _, cert := range tt.chain {
+				certificate.Certificate = append(certificate.Certificate, cert.Raw)
+			}
+			certificate.PrivateKey = tt.key
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+			server.StartTLS()
+			defer server.Close()
+
+			client, err := NewAPIClient(APIClientConfig{
+				BaseURL:       server.URL,
+				IsTLS:         true,
+				SkipTLSVerify: true,
+				TLSPins:       []string{base64.StdEncoding.EncodeToString(tt.pin[:])},
+				Retry:         RetryConfig{MaxAttempts: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Get(context.Background(), "/api/v1/status", nil)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "matches none of the configured pins") {
+				t.Errorf("expected pin mismatch error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCertificateExpiryWarning(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	certPEM, keyDER := generateCert(t, "expiring-runner", time.Now().Add(3*24*time.Hour))
+	_, err := configureTLS(APIClientConfig{
+		ClientCertPEM:     string(certPEM),
+		ClientCertKeyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		CertExpiryWarning: 7 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "client certificate \"CN=expiring-runner\"") {
+		t.Errorf("expected expiry warning, got %q", buf.String())
+	}
+}
@@ -0,0 +1,242 @@
+package ankacloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+// UAKCredentials is the content of the runner host file holding a controller API key (UAK).
+// The private key is either inline PEM or a path to a PEM file. The key is only used with the
+// controllers it is bound to, as anyone able to relay the handshake could get a session with it.
+type UAKCredentials struct {
+	Id             string   `json:"id"`
+	PrivateKey     string   `json:"private_key,omitempty"`
+	PrivateKeyPath string   `json:"private_key_path,omitempty"`
+	ControllerURLs []string `json:"controller_urls"`
+}
+
+func LoadUAKCredentials(path string) (UAKCredentials, error) {
+	var creds UAKCredentials
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return creds, fmt.Errorf("failed to read UAK credentials file %q: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, fmt.Errorf("failed to parse UAK credentials file %q: %w", path, err)
+	}
+	if creds.Id == "" {
+		return creds, fmt.Errorf("UAK credentials file %q is missing the key id", path)
+	}
+	if creds.PrivateKey == "" && creds.PrivateKeyPath == "" {
+		return creds, fmt.Errorf("UAK credentials file %q is missing the private key", path)
+	}
+	if len(creds.ControllerURLs) == 0 {
+		return creds, fmt.Errorf("UAK credentials file %q is missing the controller urls the key is for", path)
+	}
+	return creds, nil
+}
+
+func (c UAKCredentials) boundTo(controllerURL string) bool {
+	for _, boundURL := range c.ControllerURLs {
+		if strings.TrimSuffix(boundURL, "/") == strings.TrimSuffix(controllerURL, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c UAKCredentials) privateKey() (*rsa.PrivateKey, error) {
+	keyPEM := []byte(c.PrivateKey)
+	if c.PrivateKey == "" {
+		var err error
+		keyPEM, err = os.ReadFile(c.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read UAK private key at %q: %w", c.PrivateKeyPath, err)
+		}
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("UAK private key of %q is not PEM encoded", c.Id)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse UAK private key of %q: %w", c.Id, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("UAK private key of %q is not an RSA key", c.Id)
+	}
+	return key, nil
+}
+
+// uakAuthenticator implements the controller's API key flow: the controller sends a challenge
+// encrypted with the key's public part, and exchanges the decrypted secret for a session token.
+type uakAuthenticator struct {
+	controllerURL string
+	httpClient    *http.Client
+	id            string
+	key           *rsa.PrivateKey
+	cache         *tokenCache
+
+	mu    sync.Mutex
+	token cachedToken
+}
+
+func newUAKAuthenticator(controllerURL string, httpClient *http.Client, creds UAKCredentials, cacheDir string) (*uakAuthenticator, error) {
+	if !creds.boundTo(controllerURL) {
+		return nil, fmt.Errorf("UAK %s is not bound to controller %s, only to %s", creds.Id, controllerURL, strings.Join(creds.ControllerURLs, ", "))
+	}
+
+	key, err := creds.privateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &uakAuthenticator{
+		controllerURL: controllerURL,
+		httpClient:    httpClient,
+		id:            creds.Id,
+		key:           key,
+		cache:         newTokenCache(cacheDir, "uak|"+controllerURL+"|"+creds.Id),
+	}, nil
+}
+
+func (a *uakAuthenticator) Authorize(ctx context.Context, req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.token.valid(time.Now(), 0) {
+		a.token = a.cache.load()
+	}
+
+	if !a.token.valid(time.Now(), 0) {
+		token, err := a.handshake(ctx)
+		if err != nil {
+			return err
+		}
+		a.token = cachedToken{Token: token}
+		a.cache.store(a.token)
+	}
+
+	log.RegisterSecret(a.token.Token)
+	req.Header.Set("Authorization", "Bearer "+a.token.Token)
+	return nil
+}
+
+func (a *uakAuthenticator) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.token = cachedToken{}
+	a.cache.clear()
+}
+
+type uakHandRequest struct {
+	Id string `json:"id"`
+}
+
+type uakShakeRequest struct {
+	Id     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+type uakResponse struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Body    json.RawMessage `json:"body"`
+}
+
+func (a *uakAuthenticator) handshake(ctx context.Context) (string, error) {
+	log.Debugf("authenticating with controller using UAK %s\n", a.id)
+
+	challengeBody, err := a.post(ctx, "/tap/v1/hand", uakHandRequest{Id: a.id})
+	if err != nil {
+		return "", fmt.Errorf("failed to get UAK challenge: %w", err)
+	}
+
+	var encodedChallenge string
+	if err := json.Unmarshal(challengeBody, &encodedChallenge); err != nil {
+		return "", fmt.Errorf("failed to parse UAK challenge: %w", err)
+	}
+	challenge, err := base64.StdEncoding.DecodeString(encodedChallenge)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode UAK challenge: %w", err)
+	}
+
+	secret, err := rsa.DecryptOAEP(sha256.New(), nil, a.key, challenge, nil)
+	if err != nil {
+		// older controllers encrypt the challenge with PKCS #1 v1.5 padding
+		var pkcs1Err error
+		secret, pkcs1Err = rsa.DecryptPKCS1v15(nil, a.key, challenge)
+		if pkcs1Err != nil {
+			return "", fmt.Errorf("failed to decrypt UAK challenge, does the key match UAK %s? %w", a.id, err)
+		}
+	}
+
+	tokenBody, err := a.post(ctx, "/tap/v1/shake", uakShakeRequest{Id: a.id, Secret: string(secret)})
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange UAK challenge for a session token: %w", err)
+	}
+
+	// the session is either returned as a ready to use token, or as an object to pass on base64 encoded
+	var token string
+	if err := json.Unmarshal(tokenBody, &token); err != nil {
+		token = base64.StdEncoding.EncodeToString(tokenBody)
+	}
+	return token, nil
+}
+
+func (a *uakAuthenticator) post(ctx context.Context, endpoint string, payload any) (json.RawMessage, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointUrl := fmt.Sprintf("%s%s", a.controllerURL, endpoint)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointUrl, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create POST request to %q: %w", endpointUrl, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send POST request to %s: %w", endpointUrl, err)
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	var response uakResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("status code: %d, failed to decode response body %q: %w", r.StatusCode, string(body), err)
+	}
+	if r.StatusCode != http.StatusOK || response.Status != statusOK {
+		return nil, fmt.Errorf("status code: %d, error: %s", r.StatusCode, response.Message)
+	}
+
+	return response.Body, nil
+}
@@ -0,0 +1,148 @@
+package ankacloud
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUAKAuthentication(t *testing.T) {
+	const (
+		uakId  = "fake-uak-id"
+		secret = "fake-secret"
+	)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handshakes int
+	var rejected bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tap/v1/hand":
+			var req uakHandRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.Id != uakId {
+				t.Errorf("expected UAK id %q, got %q", uakId, req.Id)
+			}
+			challenge, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, []byte(secret), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			json.NewEncoder(w).Encode(response{Status: statusOK, Body: base64.StdEncoding.EncodeToString(challenge)})
+		case "/tap/v1/shake":
+			var req uakShakeRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.Secret != secret {
+				t.Errorf("expected decrypted secret %q, got %q", secret, req.Secret)
+			}
+			handshakes++
+			json.NewEncoder(w).Encode(response{Status: statusOK, Body: fmt.Sprintf("session-%d", handshakes)})
+		default:
+			// reject the first session once, as if it expired
+			if r.Header.Get("Authorization") == "Bearer session-1" && !rejected {
+				rejected = true
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(response{Status: "FAIL", Message: "unauthorized"})
+				return
+			}
+			if r.Header.Get("Authorization") == "" {
+				t.Errorf("expected authorization header")
+			}
+			json.NewEncoder(w).Encode(response{Status: statusOK})
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	credsPath := filepath.Join(dir, "uak.json")
+	creds, _ := json.Marshal(UAKCredentials{Id: uakId, PrivateKeyPath: keyPath, ControllerURLs: []string{server.URL + "/"}})
+	if err := os.WriteFile(credsPath, creds, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewAPIClient(APIClientConfig{
+		BaseURL:            server.URL,
+		UAKCredentialsPath: credsPath,
+		TokenCacheDir:      filepath.Join(dir, "tokens"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Post(context.Background(), "/api/v1/vm", map[string]string{"vmid": "fake"}); err != nil {
+		t.Fatal(err)
+	}
+	if handshakes != 2 {
+		t.Errorf("expected a second handshake after the session was rejected, got %d handshakes", handshakes)
+	}
+
+	// a new client, like the next stage process, reuses the cached session
+	client, err = NewAPIClient(APIClientConfig{
+		BaseURL:            server.URL,
+		UAKCredentialsPath: credsPath,
+		TokenCacheDir:      filepath.Join(dir, "tokens"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(context.Background(), "/api/v1/vm", nil); err != nil {
+		t.Fatal(err)
+	}
+	if handshakes != 2 {
+		t.Errorf("expected cached session to be reused, got %d handshakes", handshakes)
+	}
+}
+
+func TestUAKBoundToControllers(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	dir := t.TempDir()
+	for name, creds := range map[string]UAKCredentials{
+		"unbound.json":    {Id: "fake-uak-id", PrivateKey: string(keyPEM)},
+		"other-host.json": {Id: "fake-uak-id", PrivateKey: string(keyPEM), ControllerURLs: []string{"https://controller.example.com"}},
+	} {
+		credsPath := filepath.Join(dir, name)
+		data, _ := json.Marshal(creds)
+		if err := os.WriteFile(credsPath, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewAPIClient(APIClientConfig{BaseURL: server.URL, UAKCredentialsPath: credsPath}); err == nil {
+			t.Errorf("expected %s to be refused for controller %s", name, server.URL)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("expected no handshake, got %d requests", requests)
+	}
+}
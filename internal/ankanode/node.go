@@ -0,0 +1,543 @@
+package ankanode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/audit"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSSHPort  = "22"
+	defaultAnkaPath = "anka"
+	vmSSHPort       = "22"
+	vmNamePrefix    = "anka-gle-"
+	pollingInterval = 2 * time.Second
+)
+
+// Config describes how to reach a bare Anka node over SSH
+type Config struct {
+	// Host is the node's address, with an optional :port
+	Host     string
+	User     string
+	Password string
+	KeyPath  string
+	// HostKey is the node's SSH host public key, in authorized_keys format, or its SHA256 fingerprint
+	// (like ssh-keygen -l). When empty, the host key is not checked at all, and a changed key goes unnoticed.
+	HostKey string
+	// AnkaPath is the anka CLI on the node, "anka" by default
+	AnkaPath string
+}
+
+// Node runs Anka VMs on a single node without a controller, by driving the anka CLI over SSH.
+// VMs are named after the job's external id, so the same stages find them again without any state.
+type Node struct {
+	config       Config
+	clientConfig *ssh.ClientConfig
+	addr         string
+
+	mu     sync.Mutex
+	client *ssh.Client
+
+	// run executes a shell command on the node, returning its stdout
+	run func(ctx context.Context, command string) ([]byte, error)
+}
+
+type ankaResponse struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Body    json.RawMessage `json:"body"`
+}
+
+type vmInfo struct {
+	UUID   string `json:"uuid"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	IP     string `json:"ip,omitempty"`
+}
+
+func NewNode(config Config) (*Node, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("node host is required")
+	}
+	if config.AnkaPath == "" {
+		config.AnkaPath = defaultAnkaPath
+	}
+
+	var auth []ssh.AuthMethod
+	if config.KeyPath != "" {
+		key, err := os.ReadFile(config.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read node SSH key at %q: %w", config.KeyPath, err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse node SSH key at %q: %w", config.KeyPath, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("node SSH key or password is required")
+	}
+
+	addr := config.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultSSHPort)
+	}
+
+	hostKeyCallback, err := hostKeyCallback(config.HostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		config: config,
+		addr:   addr,
+		clientConfig: &ssh.ClientConfig{
+			HostKeyCallback: hostKeyCallback,
+			User:            config.User,
+			Auth:            auth,
+			Timeout:         30 * time.Second,
+		},
+	}
+	n.run = n.runSSH
+	return n, nil
+}
+
+// hostKeyCallback checks the node's host key against the configured one, refusing to connect on mismatch
+func hostKeyCallback(hostKey string) (ssh.HostKeyCallback, error) {
+	hostKey = strings.TrimSpace(hostKey)
+	if hostKey == "" {
+		log.Warnf("ANKA_CLOUD_NODE_SSH_HOST_KEY is not set, the node's SSH host key is not checked\n")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	if strings.HasPrefix(hostKey, "SHA256:") {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); fingerprint != hostKey {
+				return fmt.Errorf("node %s host key %s does not match the configured %s", hostname, fingerprint, hostKey)
+			}
+			return nil
+		}, nil
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse node SSH host key %q, expected a public key or a SHA256 fingerprint: %w", hostKey, err)
+	}
+	return ssh.FixedHostKey(key), nil
+}
+
+// URL identifies the node in the state journal, the way controller URLs identify controllers
+func (n *Node) URL() string {
+	return "ssh://" + n.addr
+}
+
+// Close closes the SSH connection to the node, if one was opened
+func (n *Node) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.client == nil {
+		return nil
+	}
+	err := n.client.Close()
+	n.client = nil
+	return err
+}
+
+func (n *Node) sshClient() (*ssh.Client, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.client != nil {
+		return n.client, nil
+	}
+	log.SSH.Debugf("connecting to node %s\n", n.addr)
+	client, err := ssh.Dial("tcp", n.addr, n.clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node %s: %w", n.addr, err)
+	}
+	n.client = client
+	return client, nil
+}
+
+func (n *Node) runSSH(ctx context.Context, command string) ([]byte, error) {
+	client, err := n.sshClient()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start new ssh session on node %s: %w", n.addr, err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+
+	select {
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		return nil, ctx.Err()
+	case err := <-done:
+		// the machine readable output reports failures itself, so it is returned along with the exit error
+		if err != nil && stdout.Len() == 0 {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return stdout.Bytes(), nil
+	}
+}
+
+// anka runs an anka CLI command on the node and returns the body of its machine readable output
+func (n *Node) anka(ctx context.Context, args ...string) (json.RawMessage, error) {
+	command := []string{shellQuote(n.config.AnkaPath), "--machine-readable"}
+	for _, arg := range args {
+		command = append(command, shellQuote(arg))
+	}
+	log.SSH.Debugf("running on node %s: %s\n", n.addr, strings.Join(command, " "))
+
+	out, err := n.run(ctx, strings.Join(command, " "))
+	if err != nil {
+		return nil, fmt.Errorf("anka %s: %w", args[0], err)
+	}
+
+	var response ankaResponse
+	if err := json.Unmarshal(out, &response); err != nil {
+		return nil, fmt.Errorf("anka %s: failed to parse output %q: %w", args[0], string(out), err)
+	}
+	if !strings.EqualFold(response.Status, "OK") {
+		return nil, fmt.Errorf("anka %s: %s", args[0], response.Message)
+	}
+	return response.Body, nil
+}
+
+func (n *Node) listVMs(ctx context.Context) ([]vmInfo, error) {
+	body, err := n.anka(ctx, "list")
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []vmInfo
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &vms); err != nil {
+			return nil, fmt.Errorf("failed to parse VM list %q: %w", string(body), err)
+		}
+	}
+	return vms, nil
+}
+
+func (n *Node) showVM(ctx context.Context, name string) (*vmInfo, error) {
+	body, err := n.anka(ctx, "show", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var vm vmInfo
+	if err := json.Unmarshal(body, &vm); err != nil {
+		return nil, fmt.Errorf("failed to parse VM %s details %q: %w", name, string(body), err)
+	}
+	return &vm, nil
+}
+
+// VMName is the name of the VM created for the external id
+func VMName(externalId string) string {
+	sum := sha256.Sum256([]byte(externalId))
+	return vmNamePrefix + hex.EncodeToString(sum[:])[:16]
+}
+
+func (n *Node) instance(vm vmInfo, externalId string) *ankacloud.Instance {
+	state := ankacloud.StateScheduling
+	switch strings.ToLower(vm.Status) {
+	case "running":
+		if vm.IP != "" {
+			state = ankacloud.StateStarted
+		}
+	case "stopped", "suspended", "failed":
+		state = ankacloud.StateError
+	}
+
+	return &ankacloud.Instance{
+		State:      state,
+		Id:         vm.Name,
+		ExternalId: externalId,
+		VMInfo:     &ankacloud.VM{Name: vm.Name},
+		NodeId:     n.addr,
+		Node:       n.node(),
+		// the VM is a clone, with a UUID of its own: the template it was cloned from is not known here
+	}
+}
+
+func (n *Node) node() *ankacloud.Node {
+	host, _, _ := net.SplitHostPort(n.addr)
+	return &ankacloud.Node{Id: n.addr, Name: host, IP: host}
+}
+
+func (n *Node) GetNode(ctx context.Context, req ankacloud.GetNodeRequest) (*ankacloud.Node, error) {
+	return n.node(), nil
+}
+
+// GetTemplateIdByName returns the UUID of the VM template named templateName on the node
+func (n *Node) GetTemplateIdByName(ctx context.Context, templateName string) (string, error) {
+	vms, err := n.listVMs(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list VMs: %w", err)
+	}
+	for _, vm := range vms {
+		if vm.Name == templateName {
+			return vm.UUID, nil
+		}
+	}
+	return "", fmt.Errorf("template %q %w", templateName, ankacloud.ErrNotFound)
+}
+
+// CreateInstance clones the template into a VM named after the external id, and starts it.
+// A VM already created for the external id, say by a retried prepare stage, is reused.
+func (n *Node) CreateInstance(ctx context.Context, req ankacloud.CreateInstanceRequest) (string, error) {
+	if req.ExternalId == "" {
+		return "", fmt.Errorf("external id is required to create a VM on a node")
+	}
+	name := VMName(req.ExternalId)
+
+	vms, err := n.listVMs(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list VMs: %w", err)
+	}
+	for _, vm := range vms {
+		if vm.Name == name {
+			log.Printf("VM %s already exists for %s, reusing it\n", name, req.ExternalId)
+			return name, n.startVM(ctx, name)
+		}
+	}
+
+	if req.Tag != "" {
+		section := log.StartSection("pulling", "Pulling tag %q of template %s to node %s", req.Tag, req.TemplateId, n.addr)
+		pullStart := time.Now()
+		if _, err := n.anka(ctx, "registry", "pull", "--tag", req.Tag, req.TemplateId); err != nil {
+			section.End("failed to pull tag %q", req.Tag)
+			return "", fmt.Errorf("failed to pull tag %q of template %s: %w", req.Tag, req.TemplateId, err)
+		}
+		metrics.Observe(metrics.PullSeconds, time.Since(pullStart).Seconds())
+		section.End("tag %q pulled to node %s", req.Tag, n.addr)
+	}
+
+	if _, err := n.anka(ctx, "clone", req.TemplateId, name); err != nil {
+		return "", fmt.Errorf("failed to clone template %s: %w", req.TemplateId, err)
+	}
+
+	if err := n.configureVM(ctx, name, req); err != nil {
+		n.deleteVM(ctx, name)
+		return "", err
+	}
+
+	if err := n.startVM(ctx, name); err != nil {
+		n.deleteVM(ctx, name)
+		return "", err
+	}
+	return name, nil
+}
+
+func (n *Node) configureVM(ctx context.Context, name string, req ankacloud.CreateInstanceRequest) error {
+	if req.Vcpu > 0 {
+		if _, err := n.anka(ctx, "modify", name, "cpu", fmt.Sprint(req.Vcpu)); err != nil {
+			return fmt.Errorf("failed to set vcpu of VM %s: %w", name, err)
+		}
+	}
+	if req.VramMb > 0 {
+		if _, err := n.anka(ctx, "modify", name, "ram", fmt.Sprintf("%dM", req.VramMb)); err != nil {
+			return fmt.Errorf("failed to set vram of VM %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (n *Node) startVM(ctx context.Context, name string) error {
+	if _, err := n.anka(ctx, "start", name); err != nil {
+		return fmt.Errorf("failed to start VM %s: %w", name, err)
+	}
+	return nil
+}
+
+func (n *Node) deleteVM(ctx context.Context, name string) error {
+	if _, err := n.anka(ctx, "stop", "--force", name); err != nil {
+		log.Debugf("failed to stop VM %s: %s\n", name, err)
+	}
+	_, err := n.anka(ctx, "delete", "--yes", name)
+	return err
+}
+
+// WaitForInstanceToBeScheduled waits for the VM to run and get an IP address
+func (n *Node) WaitForInstanceToBeScheduled(ctx context.Context, instanceId string) (instance *ankacloud.Instance, err error) {
+	ctx, span := tracing.Start(ctx, "wait for instance", tracing.KindInternal)
+	span.SetAttribute("anka.instance.id", instanceId)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	var lastStatus string
+	section := log.StartSection("booting", "Waiting for VM %s to boot", instanceId)
+	bootStart := time.Now()
+	defer section.End("VM %s did not boot", instanceId)
+	for {
+		vm, err := n.showVM(ctx, instanceId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get VM %s status: %w", instanceId, err)
+		}
+		instance := n.instance(*vm, "")
+		log.Controller.Colorf("VM %s is %s\n", instanceId, vm.Status)
+		if vm.Status != lastStatus {
+			audit.Record(audit.Event{Action: audit.ActionInstanceState, InstanceId: instanceId, State: vm.Status})
+			span.SetAttribute("anka.instance.state", vm.Status)
+			lastStatus = vm.Status
+		}
+		switch instance.State {
+		case ankacloud.StateStarted:
+			metrics.Observe(metrics.BootSeconds, time.Since(bootStart).Seconds())
+			section.End("VM %s booted with IP %s", instanceId, vm.IP)
+			return instance, nil
+		case ankacloud.StateError:
+			return nil, fmt.Errorf("VM %s is in an unexpected state: %s", instanceId, vm.Status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollingInterval):
+		}
+	}
+}
+
+func (n *Node) GetInstance(ctx context.Context, req ankacloud.GetInstanceRequest) (*ankacloud.Instance, error) {
+	vm, err := n.showVM(ctx, req.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VM %s: %w", req.Id, err)
+	}
+	return n.instance(*vm, ""), nil
+}
+
+func (n *Node) GetInstancesByExternalId(ctx context.Context, externalId string) ([]*ankacloud.Instance, error) {
+	vms, err := n.listVMs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	name := VMName(externalId)
+	var instances []*ankacloud.Instance
+	for _, vm := range vms {
+		if vm.Name != name {
+			continue
+		}
+		// the list has no addresses, so running VMs are shown to get theirs
+		if strings.EqualFold(vm.Status, "running") && vm.IP == "" {
+			if details, err := n.showVM(ctx, vm.Name); err == nil {
+				vm = *details
+			}
+		}
+		instances = append(instances, n.instance(vm, externalId))
+	}
+	return instances, nil
+}
+
+func (n *Node) GetInstanceByExternalId(ctx context.Context, externalId string) (*ankacloud.Instance, error) {
+	instances, err := n.GetInstancesByExternalId(ctx, externalId)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("VM %s of %s %w", VMName(externalId), externalId, ankacloud.ErrNotFound)
+	}
+	return instances[0], nil
+}
+
+// TerminateInstance stops and deletes the VM
+func (n *Node) TerminateInstance(ctx context.Context, req ankacloud.TerminateInstanceRequest) error {
+	if err := n.deleteVM(ctx, req.Id); err != nil {
+		return fmt.Errorf("failed to delete VM %s: %w", req.Id, err)
+	}
+	return nil
+}
+
+// WaitForInstancesToBeTerminated polls the VM list until none of the VMs is left or the context is done.
+// It returns the names of the VMs still on the node.
+func (n *Node) WaitForInstancesToBeTerminated(ctx context.Context, instanceIds []string, pollingInterval time.Duration) []string {
+	pending := instanceIds
+	for {
+		vms, err := n.listVMs(ctx)
+		if err != nil {
+			log.Debugf("failed to list VMs: %s\n", err)
+		} else {
+			var stillPending []string
+			for _, vm := range vms {
+				for _, id := range pending {
+					if vm.Name == id {
+						stillPending = append(stillPending, id)
+					}
+				}
+			}
+			pending = stillPending
+		}
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-time.After(pollingInterval):
+		}
+	}
+}
+
+// DialVM connects to the SSH port of the instance's VM through the node, since VM addresses
+// are only reachable from the node itself
+func (n *Node) DialVM(ctx context.Context, instance *ankacloud.Instance) (net.Conn, string, error) {
+	vm, err := n.showVM(ctx, instance.Id)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get VM %s address: %w", instance.Id, err)
+	}
+	if vm.IP == "" {
+		return nil, "", fmt.Errorf("VM %s has no IP address (status %s)", instance.Id, vm.Status)
+	}
+
+	client, err := n.sshClient()
+	if err != nil {
+		return nil, "", err
+	}
+
+	addr := net.JoinHostPort(vm.IP, vmSSHPort)
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to reach %s through node %s: %w", addr, n.addr, err)
+	}
+	return conn, addr, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,186 @@
+package ankanode
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"golang.org/x/crypto/ssh"
+)
+
+const jobURL = "https://gitlab.example.com/group/project/-/jobs/1"
+
+// fakeNode answers anka commands from a table of outputs keyed by subcommand, and records the commands
+type fakeNode struct {
+	outputs  map[string]string
+	commands []string
+}
+
+func (f *fakeNode) run(ctx context.Context, command string) ([]byte, error) {
+	f.commands = append(f.commands, command)
+	args := strings.Fields(strings.ReplaceAll(command, "'", ""))
+	if len(args) < 3 {
+		return nil, fmt.Errorf("unexpected command %q", command)
+	}
+	if out, ok := f.outputs[args[2]]; ok {
+		return []byte(out), nil
+	}
+	return []byte(`{"status": "OK", "body": {}}`), nil
+}
+
+func newTestNode(t *testing.T, outputs map[string]string) (*Node, *fakeNode) {
+	t.Helper()
+	n, err := NewNode(Config{Host: "mac-1.lab", User: "ci", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeNode{outputs: outputs}
+	n.run = fake.run
+	return n, fake
+}
+
+func TestCreateInstance(t *testing.T) {
+	n, fake := newTestNode(t, map[string]string{
+		"list": `{"status": "OK", "body": [{"name": "sonoma", "uuid": "1111", "status": "stopped"}]}`,
+	})
+
+	name, err := n.CreateInstance(context.Background(), ankacloud.CreateInstanceRequest{
+		TemplateId: "1111",
+		Tag:        "xcode-15",
+		ExternalId: jobURL,
+		Vcpu:       4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != VMName(jobURL) {
+		t.Errorf("expected VM name %q, got %q", VMName(jobURL), name)
+	}
+
+	expected := []string{
+		"'anka' --machine-readable 'list'",
+		"'anka' --machine-readable 'registry' 'pull' '--tag' 'xcode-15' '1111'",
+		fmt.Sprintf("'anka' --machine-readable 'clone' '1111' '%s'", name),
+		fmt.Sprintf("'anka' --machine-readable 'modify' '%s' 'cpu' '4'", name),
+		fmt.Sprintf("'anka' --machine-readable 'start' '%s'", name),
+	}
+	if strings.Join(fake.commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected commands:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(fake.commands, "\n"))
+	}
+}
+
+func TestCreateInstanceReusesExistingVM(t *testing.T) {
+	n, fake := newTestNode(t, map[string]string{
+		"list": fmt.Sprintf(`{"status": "OK", "body": [{"name": %q, "uuid": "2222", "status": "stopped"}]}`, VMName(jobURL)),
+	})
+
+	if _, err := n.CreateInstance(context.Background(), ankacloud.CreateInstanceRequest{TemplateId: "1111", ExternalId: jobURL}); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range fake.commands {
+		if strings.Contains(command, "'clone'") {
+			t.Errorf("expected existing VM to be reused, got %q", command)
+		}
+	}
+}
+
+func TestGetInstancesByExternalId(t *testing.T) {
+	n, _ := newTestNode(t, map[string]string{
+		"list": fmt.Sprintf(`{"status": "OK", "body": [{"name": "sonoma", "uuid": "1111", "status": "stopped"}, {"name": %q, "uuid": "2222", "status": "running"}]}`, VMName(jobURL)),
+		"show": fmt.Sprintf(`{"status": "OK", "body": {"name": %q, "uuid": "2222", "status": "running", "ip": "192.168.64.3"}}`, VMName(jobURL)),
+	})
+
+	instances, err := n.GetInstancesByExternalId(context.Background(), jobURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(instances))
+	}
+	if instances[0].State != ankacloud.StateStarted || instances[0].ExternalId != jobURL {
+		t.Errorf("unexpected instance %+v", instances[0])
+	}
+	if instances[0].Node.IP != "mac-1.lab" {
+		t.Errorf("expected node IP %q, got %q", "mac-1.lab", instances[0].Node.IP)
+	}
+}
+
+func TestGetTemplateIdByNameNotFound(t *testing.T) {
+	n, _ := newTestNode(t, map[string]string{
+		"list": `{"status": "OK", "body": []}`,
+	})
+
+	_, err := n.GetTemplateIdByName(context.Background(), "missing")
+	if !errors.Is(err, ankacloud.ErrNotFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestAnkaError(t *testing.T) {
+	n, _ := newTestNode(t, map[string]string{
+		"start": `{"status": "ERROR", "code": 1, "message": "not enough resources"}`,
+	})
+
+	err := n.startVM(context.Background(), "vm")
+	if err == nil || !strings.Contains(err.Error(), "not enough resources") {
+		t.Errorf("expected anka error message, got %v", err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got := shellQuote("it's"); got != `'it'\''s'` {
+		t.Errorf("unexpected quoting %s", got)
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	nodeKey := newKey()
+	otherKey := newKey()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	tests := []struct {
+		name    string
+		hostKey string
+		wantErr bool
+	}{
+		{"not set", "", false},
+		{"public key", string(ssh.MarshalAuthorizedKey(nodeKey)), false},
+		{"fingerprint", ssh.FingerprintSHA256(nodeKey), false},
+		{"other public key", string(ssh.MarshalAuthorizedKey(otherKey)), true},
+		{"other fingerprint", ssh.FingerprintSHA256(otherKey), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callback, err := hostKeyCallback(tt.hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = callback("mac-1.lab:22", addr, nodeKey)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	if _, err := hostKeyCallback("not a key"); err == nil {
+		t.Error("expected invalid host key error")
+	}
+}
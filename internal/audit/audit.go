@@ -0,0 +1,204 @@
+// Package audit appends one JSON event per lifecycle action to a file on the runner host, next to
+// the human readable job log, for SIEM ingestion and capacity analysis. An event that can't be written
+// is dropped with a debug message, the stage carries on.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/filelock"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+const (
+	ActionStageStart         = "stage_start"
+	ActionStageEnd           = "stage_end"
+	ActionTemplateResolved   = "template_resolved"
+	ActionInstanceCreated    = "instance_created"
+	ActionInstanceState      = "instance_state"
+	ActionInstanceReady      = "instance_ready"
+	ActionSSHConnected       = "ssh_connected"
+	ActionInstanceKeptAlive  = "instance_kept_alive"
+	ActionInstanceTerminated = "instance_terminated"
+	ActionError              = "error"
+)
+
+const (
+	DefaultMaxSize  = 100 * 1024 * 1024
+	DefaultMaxFiles = 5
+)
+
+type Event struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Stage      string    `json:"stage,omitempty"`
+	JobURL     string    `json:"job_url,omitempty"`
+	ProjectId  string    `json:"project_id,omitempty"`
+	PipelineId string    `json:"pipeline_id,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+	InstanceId string    `json:"instance_id,omitempty"`
+	NodeId     string    `json:"node_id,omitempty"`
+	NodeName   string    `json:"node_name,omitempty"`
+	TemplateId string    `json:"template_id,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	State      string    `json:"state,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	// Duration is how long the action took, in milliseconds
+	Duration int64  `json:"duration_ms,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type Config struct {
+	// Path is the audit log file, events are not recorded if it is empty
+	Path string
+	// MaxSize is the size in bytes the file is rotated at
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept, as Path.1 (newest) to Path.MaxFiles
+	MaxFiles int
+}
+
+var (
+	mu         sync.Mutex
+	config     Config
+	base       Event
+	stageStart time.Time
+)
+
+// Init sets where events go, and the job context every event carries
+func Init(c Config, context Event) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if c.MaxSize <= 0 {
+		c.MaxSize = DefaultMaxSize
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = DefaultMaxFiles
+	}
+	config = c
+	base = context
+	stageStart = time.Now()
+}
+
+// Update changes the context of the following events, like the instance once it is known
+func Update(fn func(context *Event)) {
+	mu.Lock()
+	defer mu.Unlock()
+	fn(&base)
+}
+
+// Record appends the event, filling unset fields from the context
+func Record(event Event) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if config.Path == "" {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	fill(&event.Stage, base.Stage)
+	fill(&event.JobURL, base.JobURL)
+	fill(&event.ProjectId, base.ProjectId)
+	fill(&event.PipelineId, base.PipelineId)
+	fill(&event.Backend, base.Backend)
+	fill(&event.InstanceId, base.InstanceId)
+	fill(&event.NodeId, base.NodeId)
+	fill(&event.NodeName, base.NodeName)
+	fill(&event.TemplateId, base.TemplateId)
+	fill(&event.Tag, base.Tag)
+	event.Message = log.Redact(event.Message)
+	event.Error = log.Redact(event.Error)
+
+	if err := write(event); err != nil {
+		log.Debugf("failed to write audit event %s: %s\n", event.Action, err)
+	}
+}
+
+// StartStage records the start of the stage
+func StartStage() {
+	Record(Event{Action: ActionStageStart})
+}
+
+// EndStage records the end of the stage, with the process exit code and how long the stage took
+func EndStage(exitCode int, err error) {
+	mu.Lock()
+	duration := time.Since(stageStart)
+	mu.Unlock()
+
+	event := Event{Action: ActionStageEnd, ExitCode: &exitCode, Duration: duration.Milliseconds()}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	Record(event)
+}
+
+// Error records a failure that did not end the stage
+func Error(message string, err error) {
+	Record(Event{Action: ActionError, Message: message, Error: err.Error()})
+}
+
+func fill(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+func write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0700); err != nil {
+		return err
+	}
+	if info, err := os.Stat(config.Path); err == nil && info.Size()+int64(len(line)) > config.MaxSize {
+		if err := rotate(int64(len(line))); err != nil {
+			return fmt.Errorf("failed to rotate %s: %w", config.Path, err)
+		}
+	}
+
+	// stage processes of concurrent jobs share the file, appends of a single line do not interleave
+	f, err := os.OpenFile(config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(line)
+	return err
+}
+
+// rotate shifts Path.N to Path.N+1, dropping the oldest, and moves Path to Path.1. Stage processes of
+// concurrent jobs may all find the file full, only the first one to get the lock rotates it.
+func rotate(size int64) error {
+	unlock, err := filelock.Lock(config.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if info, err := os.Stat(config.Path); err != nil || info.Size()+size <= config.MaxSize {
+		return nil
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", config.Path, config.MaxFiles))
+	for i := config.MaxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", config.Path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", config.Path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(config.Path, config.Path+".1")
+}
@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readEvents(t *testing.T, path string) []Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid event %q: %s", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "events.jsonl")
+	Init(Config{Path: path}, Event{Stage: "prepare", JobURL: "https://gitlab.com/group/project/-/jobs/1", ProjectId: "1", PipelineId: "2"})
+
+	StartStage()
+	Update(func(e *Event) { e.InstanceId = "instance-1" })
+	Record(Event{Action: ActionInstanceState, State: "Pulling"})
+	Record(Event{Action: ActionSSHConnected, InstanceId: "instance-2"})
+	EndStage(1, errors.New("failed with password=hunter22"))
+
+	events := readEvents(t, path)
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(events))
+	}
+	for _, event := range events {
+		if event.JobURL != "https://gitlab.com/group/project/-/jobs/1" || event.Stage != "prepare" || event.PipelineId != "2" || event.Time.IsZero() {
+			t.Errorf("event %+v is missing the job context", event)
+		}
+	}
+	if events[0].Action != ActionStageStart || events[0].InstanceId != "" {
+		t.Errorf("unexpected first event %+v", events[0])
+	}
+	if events[1].InstanceId != "instance-1" || events[1].State != "Pulling" {
+		t.Errorf("expected instance from context, got %+v", events[1])
+	}
+	if events[2].InstanceId != "instance-2" {
+		t.Errorf("expected event instance to win over context, got %+v", events[2])
+	}
+	end := events[3]
+	if end.Action != ActionStageEnd || end.ExitCode == nil || *end.ExitCode != 1 {
+		t.Errorf("unexpected stage end %+v", end)
+	}
+	if end.Error != "failed with password=[REDACTED]" {
+		t.Errorf("expected redacted error, got %q", end.Error)
+	}
+}
+
+func TestRecordWithoutPath(t *testing.T) {
+	Init(Config{}, Event{})
+	Record(Event{Action: ActionStageStart})
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	Init(Config{Path: path, MaxSize: 200, MaxFiles: 2}, Event{Stage: "run"})
+
+	for range 20 {
+		Record(Event{Action: ActionInstanceState, State: "Started"})
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s is %d bytes, over the maximum size", name, info.Size())
+		}
+		readEvents(t, name)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files, got %s.3", path)
+	}
+}
+
+func TestRotationByConcurrentProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	Init(Config{Path: path, MaxSize: 100, MaxFiles: 3}, Event{})
+	if err := os.WriteFile(path, make([]byte, 150), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// both processes found the file full, the second one gets the lock once the first one rotated it
+	for range 2 {
+		if err := rotate(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("expected the full file to be rotated: %s", err)
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("expected a single rotation, got %s.2", path)
+	}
+}
@@ -0,0 +1,74 @@
+package command
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankanode"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
+)
+
+// Backend runs the job's VM: an Anka Build Cloud controller, or a bare Anka node driven over SSH
+// (ANKA_CLOUD_BACKEND). Features that need the controller's registry, like saving the VM as a tag,
+// check for a *ankacloud.Controller.
+type Backend interface {
+	GetTemplateIdByName(ctx context.Context, templateName string) (string, error)
+	CreateInstance(ctx context.Context, req ankacloud.CreateInstanceRequest) (string, error)
+	WaitForInstanceToBeScheduled(ctx context.Context, instanceId string) (*ankacloud.Instance, error)
+	GetInstance(ctx context.Context, req ankacloud.GetInstanceRequest) (*ankacloud.Instance, error)
+	GetInstanceByExternalId(ctx context.Context, externalId string) (*ankacloud.Instance, error)
+	GetInstancesByExternalId(ctx context.Context, externalId string) ([]*ankacloud.Instance, error)
+	TerminateInstance(ctx context.Context, req ankacloud.TerminateInstanceRequest) error
+	WaitForInstancesToBeTerminated(ctx context.Context, instanceIds []string, pollingInterval time.Duration) []string
+	GetNode(ctx context.Context, req ankacloud.GetNodeRequest) (*ankacloud.Node, error)
+}
+
+// vmDialer is implemented by backends whose VMs are reached through the backend itself,
+// instead of a port forwarded on the node
+type vmDialer interface {
+	DialVM(ctx context.Context, instance *ankacloud.Instance) (net.Conn, string, error)
+}
+
+var (
+	_ Backend  = (*ankacloud.Controller)(nil)
+	_ Backend  = (*ankanode.Node)(nil)
+	_ vmDialer = (*ankanode.Node)(nil)
+)
+
+func newNode(env gitlab.Environment) (*ankanode.Node, error) {
+	return ankanode.NewNode(ankanode.Config{
+		Host:     env.Node.Host,
+		User:     env.Node.User,
+		Password: env.Node.Password,
+		KeyPath:  env.Node.KeyPath,
+		HostKey:  env.Node.HostKey,
+		AnkaPath: env.Node.AnkaPath,
+	})
+}
+
+// selectBackend returns the backend new instances are created on, and its URL recorded in the state journal
+func selectBackend(ctx context.Context, env gitlab.Environment) (Backend, string, error) {
+	if env.Backend == gitlab.BackendNode {
+		node, err := newNode(env)
+		if err != nil {
+			return nil, "", err
+		}
+		return node, node.URL(), nil
+	}
+	return selectController(ctx, env)
+}
+
+// findJobBackend returns the backend holding the job's instance, and its URL
+func findJobBackend(ctx context.Context, env gitlab.Environment, store *state.Store) (Backend, string, error) {
+	if env.Backend == gitlab.BackendNode {
+		node, err := newNode(env)
+		if err != nil {
+			return nil, "", err
+		}
+		return node, node.URL(), nil
+	}
+	return findJobController(ctx, env, store)
+}
@@ -3,13 +3,22 @@ package command
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/audit"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/webhook"
 )
 
+const terminationPollingInterval = 5 * time.Second
+
 var cleanupCommand = &cobra.Command{
 	Use: "cleanup",
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -26,35 +35,136 @@ func executeCleanup(ctx context.Context, env gitlab.Environment) error {
 	// log.SetOutput(os.Stdout) // prevents us from logging Println, etc
 
 	log.Println("cleanup stage started for job: ", env.GitlabJobUrl)
+	// cleanup is the job's last stage, whatever happened before
+	defer tracing.EndJob()
 
-	if env.KeepAliveOnError && env.GitlabJobStatus == gitlab.JobStatusFailed {
-		log.Colorln("keeping VM alive on error")
-		return nil
-	}
+	store := getStateStore(env)
 
-	apiClientConfig := getAPIClientConfig(env)
-	apiClient, err := ankacloud.NewAPIClient(apiClientConfig)
+	backend, backendURL, err := findJobBackend(ctx, env, store)
 	if err != nil {
-		log.Errorf("cleanup: failed to initialize API client with config +%v: %v", apiClientConfig, err)
-		return fmt.Errorf("cleanup: failed to initialize API client with config +%v: %v", apiClientConfig, err)
+		log.Errorf("cleanup: %v", err)
+		return fmt.Errorf("cleanup: %v", err)
+	}
+	if len(env.ControllerURLs) > 1 || env.Backend == gitlab.BackendNode {
+		log.Printf("using %s %s\n", env.Backend, backendURL)
 	}
+	env.ControllerURL = backendURL
+	metrics.Update(func(l *metrics.Labels) { l.Controller = backendURL })
 
-	controller := ankacloud.NewController(apiClient)
+	if store != nil {
+		releaseExpiredKeepAlives(ctx, backend, store, env.ControllerURL)
+	}
 
-	instance, err := controller.GetInstanceByExternalId(ctx, env.GitlabJobUrl)
+	instances, err := backend.GetInstancesByExternalId(ctx, env.GitlabJobUrl)
 	if err != nil {
-		log.Errorf("cleanup: failed to get instance by external id %q: %v", env.GitlabJobUrl, err)
-		return fmt.Errorf("cleanup: failed to get instance by external id %q: %v", env.GitlabJobUrl, err)
+		log.Errorf("cleanup: failed to get instances by external id %q: %v", env.GitlabJobUrl, err)
+		return fmt.Errorf("cleanup: failed to get instances by external id %q: %v", env.GitlabJobUrl, err)
+	}
+	if len(instances) == 0 {
+		log.Errorf("cleanup: instance with external id %q not found", env.GitlabJobUrl)
+		return fmt.Errorf("cleanup: instance with external id %q not found", env.GitlabJobUrl)
 	}
-	log.Printf("instance id: %s\n", instance.Id)
+	fillTemplateId(store, env.GitlabJobUrl, instances...)
 
-	log.Printf("Issuing termination request for instance %s\n", instance.Id)
-	err = controller.TerminateInstanceWithRetry(ctx, ankacloud.TerminateInstanceRequest{
-		Id: instance.Id,
-	})
-	if err != nil {
-		log.Errorf("cleanup: failed to terminate instance %q: %v", instance.Id, err)
-		return fmt.Errorf("cleanup: failed to terminate instance %q: %v", instance.Id, err)
+	if env.GitlabJobStatus == gitlab.JobStatusFailed && env.Diagnostics.Enabled() {
+		if instance := ankacloud.SelectUsableInstance(instances); instance != nil && instance.State == ankacloud.StateStarted {
+			collectDiagnostics(ctx, env, backend, instance)
+		}
+	}
+
+	keptAlive := false
+	if env.KeepAliveOnError && env.GitlabJobStatus == gitlab.JobStatusFailed {
+		if instance, expiresAt := keptAliveInstance(env, store, instances); instance != nil {
+			keptAlive = true
+			instances = slices.DeleteFunc(instances, func(i *ankacloud.Instance) bool { return i.Id == instance.Id })
+			until := "its termination"
+			if !expiresAt.IsZero() {
+				until = expiresAt.Format(time.RFC3339)
+			}
+			log.Printf("keeping instance %s alive on error until %s\n", instance.Id, until)
+			audit.Record(audit.Event{Action: audit.ActionInstanceKeptAlive, InstanceId: instance.Id, NodeId: instance.NodeId, Message: "until " + until})
+			webhook.Send(ctx, webhook.Payload{Event: webhook.EventKeptAlive, Instance: webhookInstance(env, instance), KeepAliveUntil: expiresAt})
+		}
+	}
+
+	// the VM is still terminated afterwards, saving only pushes a copy of it to the registry
+	var saveAsTagErr error
+	if env.SaveAsTag.Tag != "" && env.GitlabJobStatus == gitlab.JobStatusSuccess {
+		instance := ankacloud.SelectUsableInstance(instances)
+		controller, ok := backend.(*ankacloud.Controller)
+		if !ok {
+			saveAsTagErr = fmt.Errorf("saving the VM as a tag requires the %s backend", gitlab.BackendController)
+		} else if instance != nil && instance.State == ankacloud.StateStarted {
+			saveAsTagErr = saveAsTag(ctx, env, controller, instance)
+		} else {
+			saveAsTagErr = fmt.Errorf("no started instance found")
+		}
+		if saveAsTagErr != nil {
+			log.Errorf("cleanup: failed to save VM as tag %q: %v", env.SaveAsTag.Tag, saveAsTagErr)
+			audit.Error(fmt.Sprintf("failed to save VM as tag %q", env.SaveAsTag.Tag), saveAsTagErr)
+		}
+	}
+
+	section := log.StartSection("cleanup", "Terminating instances of job %s", env.GitlabJobUrl)
+	var terminating []string
+	var failedTerminations []string
+	// webhooks go out once every termination is requested, a slow receiver must not hold them up
+	var terminated []webhook.Payload
+	terminateStart := time.Now()
+	for _, instance := range instances {
+		switch instance.State {
+		case ankacloud.StateTerminated:
+			continue
+		case ankacloud.StateTerminating:
+			log.Printf("instance %s is already terminating\n", instance.Id)
+		default:
+			log.Printf("Issuing termination request for instance %s (state %s)\n", instance.Id, instance.State)
+			err := backend.TerminateInstance(ctx, ankacloud.TerminateInstanceRequest{
+				Id: instance.Id,
+			})
+			if err != nil {
+				log.Errorf("cleanup: failed to terminate instance %q: %v", instance.Id, err)
+				audit.Record(audit.Event{Action: audit.ActionError, InstanceId: instance.Id, Message: "failed to terminate instance", Error: err.Error()})
+				failedTerminations = append(failedTerminations, instance.Id)
+				continue
+			}
+			audit.Record(audit.Event{Action: audit.ActionInstanceTerminated, InstanceId: instance.Id, State: string(instance.State)})
+			terminated = append(terminated, webhook.Payload{Event: webhook.EventTerminated, Instance: webhookInstance(env, instance)})
+		}
+		terminating = append(terminating, instance.Id)
+	}
+	webhook.Send(ctx, terminated...)
+
+	if len(terminating) > 0 && env.TerminateTimeout > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, env.TerminateTimeout)
+		unconfirmed := backend.WaitForInstancesToBeTerminated(waitCtx, terminating, terminationPollingInterval)
+		cancel()
+		if len(unconfirmed) > 0 {
+			log.Warnf("could not confirm termination of instances within %s: %s\n", env.TerminateTimeout, strings.Join(unconfirmed, ", "))
+		} else {
+			log.Printf("termination confirmed for instances: %s\n", strings.Join(terminating, ", "))
+			metrics.Observe(metrics.TerminateSeconds, time.Since(terminateStart).Seconds())
+		}
+	}
+
+	if len(failedTerminations) > 0 {
+		section.End("failed to terminate instances: %s", strings.Join(failedTerminations, ", "))
+		return fmt.Errorf("cleanup: failed to terminate instances: %s", strings.Join(failedTerminations, ", "))
+	}
+	if len(terminating) > 0 {
+		section.End("terminated instances: %s", strings.Join(terminating, ", "))
+	} else {
+		section.End("no instance left to terminate")
+	}
+
+	if store != nil && !keptAlive {
+		if err := store.Remove(env.GitlabJobUrl); err != nil {
+			log.Warnf("failed to remove job from state dir: %s\n", err)
+		}
+	}
+
+	if saveAsTagErr != nil {
+		return fmt.Errorf("cleanup: failed to save VM as tag %q: %w", env.SaveAsTag.Tag, saveAsTagErr)
 	}
 
 	log.Println("cleanup stage completed for job: ", env.GitlabJobUrl)
@@ -0,0 +1,105 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
+)
+
+const controllerHealthCheckTimeout = 5 * time.Second
+
+func newController(env gitlab.Environment, controllerURL string) (*ankacloud.Controller, error) {
+	env.ControllerURL = controllerURL
+	apiClient, err := ankacloud.NewAPIClient(getAPIClientConfig(env))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize API client for %s: %w", controllerURL, err)
+	}
+	return ankacloud.NewController(apiClient), nil
+}
+
+// checkControllerHealth tells if the controller answers its status endpoint and reports it is running
+func checkControllerHealth(ctx context.Context, controller *ankacloud.Controller) error {
+	ctx, cancel := context.WithTimeout(ctx, controllerHealthCheckTimeout)
+	defer cancel()
+
+	status, err := controller.GetStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if !status.IsRunning() {
+		return fmt.Errorf("controller status is %q", status.Status)
+	}
+	return nil
+}
+
+// selectController picks the controller new instances are created on: the first configured
+// controller that is healthy, so provisioning fails over when the primary is down.
+func selectController(ctx context.Context, env gitlab.Environment) (*ankacloud.Controller, string, error) {
+	if len(env.ControllerURLs) <= 1 {
+		controller, err := newController(env, env.ControllerURL)
+		return controller, env.ControllerURL, err
+	}
+
+	for _, controllerURL := range env.ControllerURLs {
+		controller, err := newController(env, controllerURL)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := checkControllerHealth(ctx, controller); err != nil {
+			log.Warnf("skipping controller %s: %s\n", controllerURL, err)
+			continue
+		}
+		return controller, controllerURL, nil
+	}
+
+	return nil, "", gitlab.TransientError(fmt.Errorf("none of the controllers is healthy: %s", strings.Join(env.ControllerURLs, ", ")))
+}
+
+// findJobController returns the controller holding the job's instance: the one recorded in the
+// state journal by prepare, or else the first controller that knows the job's external id.
+func findJobController(ctx context.Context, env gitlab.Environment, store *state.Store) (*ankacloud.Controller, string, error) {
+	if len(env.ControllerURLs) <= 1 {
+		controller, err := newController(env, env.ControllerURL)
+		return controller, env.ControllerURL, err
+	}
+
+	if store != nil {
+		job, ok, err := store.Load(env.GitlabJobUrl)
+		if err != nil {
+			log.Warnf("failed to read job state: %s\n", err)
+		}
+		if ok && slices.Contains(env.ControllerURLs, job.ControllerURL) {
+			log.Debugf("job is pinned to controller %s\n", job.ControllerURL)
+			controller, err := newController(env, job.ControllerURL)
+			return controller, job.ControllerURL, err
+		}
+	}
+
+	for _, controllerURL := range env.ControllerURLs {
+		controller, err := newController(env, controllerURL)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := checkControllerHealth(ctx, controller); err != nil {
+			log.Warnf("skipping controller %s: %s\n", controllerURL, err)
+			continue
+		}
+		instances, err := controller.GetInstancesByExternalId(ctx, env.GitlabJobUrl)
+		if err != nil {
+			log.Warnf("failed to look up job instance on controller %s: %s\n", controllerURL, err)
+			continue
+		}
+		if len(instances) > 0 {
+			return controller, controllerURL, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("none of the controllers has an instance with external id %q", env.GitlabJobUrl)
+}
@@ -0,0 +1,146 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/s3"
+)
+
+// collectDiagnostics gathers the configured paths and command outputs from the VM of a failed job
+// into a tarball, stored on the runner host and/or uploaded to S3. Failures are only logged, since
+// diagnostics must never get in the way of cleaning up.
+func collectDiagnostics(ctx context.Context, env gitlab.Environment, backend Backend, instance *ankacloud.Instance) {
+	diagnostics := env.Diagnostics
+	ctx, cancel := context.WithTimeout(ctx, diagnostics.Timeout)
+	defer cancel()
+
+	archiveName := fmt.Sprintf("diagnostics-%s.tar.gz", instance.Id)
+	if ref, err := gitlab.ParseJobURL(env.GitlabJobUrl, ""); err == nil {
+		archiveName = fmt.Sprintf("diagnostics-job-%s-%s.tar.gz", ref.JobId, instance.Id)
+	}
+
+	var archive *os.File
+	var err error
+	if diagnostics.Dir != "" {
+		if err := os.MkdirAll(diagnostics.Dir, 0700); err != nil {
+			log.Warnf("failed to create diagnostics dir %q: %s\n", diagnostics.Dir, err)
+			return
+		}
+		archive, err = os.Create(filepath.Join(diagnostics.Dir, archiveName))
+	} else {
+		archive, err = os.CreateTemp("", "anka-gle-diagnostics-*.tar.gz")
+		if err == nil {
+			defer os.Remove(archive.Name())
+		}
+	}
+	if err != nil {
+		log.Warnf("failed to create diagnostics archive: %s\n", err)
+		return
+	}
+	defer archive.Close()
+
+	log.Printf("collecting diagnostics from VM of instance %s\n", instance.Id)
+	if err := fetchDiagnosticsArchive(ctx, env, backend, instance, archive); err != nil {
+		log.Warnf("failed to collect diagnostics: %s\n", err)
+		return
+	}
+
+	if diagnostics.Dir != "" {
+		log.Colorf("diagnostics archive saved on the runner host at %s\n", archive.Name())
+	}
+
+	if diagnostics.S3URL != "" {
+		creds, err := s3.LoadCredentials(diagnostics.S3Credentials)
+		if err != nil {
+			log.Warnf("failed to upload diagnostics: %s\n", err)
+			return
+		}
+		if _, err := archive.Seek(0, 0); err != nil {
+			log.Warnf("failed to upload diagnostics: %s\n", err)
+			return
+		}
+		objectURL := fmt.Sprintf("%s/%s", diagnostics.S3URL, archiveName)
+		if err := s3.NewClient(creds).PutObject(ctx, objectURL, archive); err != nil {
+			log.Warnf("failed to upload diagnostics to %s: %s\n", objectURL, err)
+			return
+		}
+		log.Colorf("diagnostics archive uploaded to %s\n", objectURL)
+	}
+}
+
+func fetchDiagnosticsArchive(ctx context.Context, env gitlab.Environment, backend Backend, instance *ankacloud.Instance, archive *os.File) error {
+	sshClient, err := dialVM(ctx, env, backend, instance)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to start new ssh session: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = strings.NewReader(diagnosticsScript(env.Diagnostics.Paths, env.Diagnostics.Commands))
+	session.Stdout = archive
+	session.Stderr = &stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run("/bin/bash -s")
+	}()
+
+	select {
+	case <-ctx.Done():
+		sshClient.Close()
+		return fmt.Errorf("timed out collecting diagnostics: %w", ctx.Err())
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("diagnostics script failed: %w: %s", err, stderr.String())
+		}
+	}
+	return nil
+}
+
+// diagnosticsScript builds a bash script that copies the paths and command outputs to a temporary
+// directory in the VM, then writes it as a gzipped tarball to stdout.
+func diagnosticsScript(paths []string, commands []string) string {
+	var script strings.Builder
+	script.WriteString("set -u\n")
+	script.WriteString("dir=$(mktemp -d /tmp/anka-gle-diagnostics.XXXXXX)\n")
+	script.WriteString("mkdir -p \"$dir/files\" \"$dir/commands\"\n")
+
+	for _, path := range paths {
+		quoted := shellQuote(path)
+		// expand a leading ~ the way users expect, without letting the shell expand anything else
+		if strings.HasPrefix(path, "~/") {
+			quoted = "\"$HOME\"/" + shellQuote(strings.TrimPrefix(path, "~/"))
+		}
+		fmt.Fprintf(&script, "cp -R %s \"$dir/files/\" 2>>\"$dir/errors.txt\" || true\n", quoted)
+	}
+
+	for i, command := range commands {
+		fmt.Fprintf(&script, "echo %s >> \"$dir/commands/index.txt\"\n", shellQuote(fmt.Sprintf("%d: %s", i+1, command)))
+		// each command runs in its own shell, so a broken one cannot break the script (nor read it from stdin)
+		fmt.Fprintf(&script, "/bin/bash -c %s < /dev/null > \"$dir/commands/%d.txt\" 2>&1 || true\n", shellQuote(command), i+1)
+	}
+
+	script.WriteString("tar -czf - -C \"$dir\" .\n")
+	script.WriteString("status=$?\n")
+	script.WriteString("rm -rf \"$dir\"\n")
+	script.WriteString("exit $status\n")
+	return script.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"golang.org/x/crypto/ssh"
+)
+
+// errorCategories name the controller failure categories in metrics
+var errorCategories = []struct {
+	err  error
+	name string
+}{
+	{ankacloud.ErrNotFound, "not_found"},
+	{ankacloud.ErrUnauthorized, "unauthorized"},
+	{ankacloud.ErrForbidden, "forbidden"},
+	{ankacloud.ErrCapacity, "capacity"},
+	{ankacloud.ErrBadRequest, "bad_request"},
+	{ankacloud.ErrServerError, "server_error"},
+}
+
+// errorCategory names what a stage failed on, for metrics
+func errorCategory(err error) string {
+	for _, category := range errorCategories {
+		if errors.Is(err, category.err) {
+			return category.name
+		}
+	}
+	var exitErr *ssh.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return "script"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	case errors.Is(err, gitlab.ErrTransient):
+		return "system"
+	}
+	return "build"
+}
+
+// controllerFailure picks how a failed controller request ends the job: as a system failure
+// (TransientError) when trying again later may help, or as a build failure with a hint when the
+// configuration has to change first.
+func controllerFailure(err error) error {
+	switch {
+	case errors.Is(err, ankacloud.ErrUnauthorized):
+		return fmt.Errorf("%w\nthe Controller rejected the credentials, check ANKA_CLOUD_UAK_CREDENTIALS_PATH, the ANKA_CLOUD_OAUTH_ variables or the client certificate", err)
+	case errors.Is(err, ankacloud.ErrForbidden):
+		var apiErr *ankacloud.APIError
+		errors.As(err, &apiErr)
+		return fmt.Errorf("%w\nthe credentials are not allowed to %s %s, check their permissions on the Controller", err, apiErr.Method, apiErr.Endpoint)
+	case errors.Is(err, ankacloud.ErrNotFound):
+		return fmt.Errorf("%w\ncheck that the template, tag, node or node group set for the job exist", err)
+	case errors.Is(err, ankacloud.ErrBadRequest):
+		return fmt.Errorf("%w\nthe Controller refused the request, check the job's ANKA_CLOUD_ variables", err)
+	}
+	// the controller could not be reached, is overloaded or failed on its side
+	return gitlab.TransientError(err)
+}
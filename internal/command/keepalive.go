@@ -0,0 +1,163 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
+)
+
+// keepAliveOnError records the instance of a job whose run stage failed as kept alive until its expiry,
+// and prints how to reach and release it. It runs in the run stage, whose output is the job log, unlike
+// the cleanup stage's that only makes it to the runner log. Cleanup then leaves the instance alone.
+func keepAliveOnError(ctx context.Context, env gitlab.Environment, backend Backend, store *state.Store, instance *ankacloud.Instance) {
+	now := time.Now()
+	expiresAt := now.Add(env.KeepAliveDuration)
+
+	if store == nil {
+		log.Warnln("ANKA_CLOUD_STATE_DIR is not set, so the kept alive VM will not expire on its own. Use `anka-gle reap --ttl` or terminate it manually")
+	} else if !recordKeptAlive(env, store, instance, now, expiresAt) {
+		return
+	}
+
+	vmName := ""
+	if instance.VMInfo != nil {
+		vmName = instance.VMInfo.Name
+	}
+	log.Warnf("keeping VM %s (instance %s) alive on error until %s\n", vmName, instance.Id, expiresAt.Format(time.RFC3339))
+
+	sshUserName := env.SSHUserName
+	if sshUserName == "" {
+		sshUserName = defaultSshUserName
+	}
+	node, err := backend.GetNode(ctx, ankacloud.GetNodeRequest{Id: instance.NodeId})
+	if _, ok := backend.(vmDialer); ok && err == nil {
+		log.Warnf("connect from node %s with: anka run %s bash\n", node.Name, instance.Id)
+		log.Warnf("release it early by running `anka delete --yes %s` on node %s\n", instance.Id, node.Name)
+		return
+	} else if err != nil {
+		log.Warnf("failed to get node %s of kept alive VM: %s\n", instance.NodeId, err)
+	} else if port, err := getNodeSSHPort(instance); err != nil {
+		log.Warnf("failed to get SSH port of kept alive VM: %s\n", err)
+	} else {
+		log.Warnf("connect with: ssh -p %d %s@%s (node %s)\n", port, sshUserName, node.IP, node.Name)
+	}
+
+	release := fmt.Sprintf("anka-gle reap --controller-url %s --release %s", env.ControllerURL, instance.Id)
+	if store != nil {
+		release += " --state-dir " + store.Dir()
+	}
+	log.Warnf("release it early by running `%s` on the runner host, or by terminating instance %s on the Controller\n", release, instance.Id)
+}
+
+// recordKeptAlive journals the instance as kept alive, unless the job did already or the project has no
+// spot left. Counting and recording happen under the state lock, so concurrently failing jobs can't both
+// take the last spot. The lock is only held for local file access: a stale lock would be broken by others.
+func recordKeptAlive(env gitlab.Environment, store *state.Store, instance *ankacloud.Instance, now time.Time, expiresAt time.Time) bool {
+	unlock, err := store.Lock()
+	if err != nil {
+		log.Warnf("%s, VM will be terminated\n", err)
+		return false
+	}
+	defer unlock()
+
+	job, _, err := store.Load(env.GitlabJobUrl)
+	if err != nil {
+		log.Warnf("%s\n", err)
+	}
+	if job.IsKeptAlive(now) && job.InstanceId == instance.Id {
+		// an earlier step of the job failed already
+		return false
+	}
+
+	if env.KeepAliveMaxPerProject > 0 {
+		keptAlive, err := countKeptAlive(store, env.ProjectId, env.GitlabJobUrl, now)
+		if err != nil {
+			log.Warnf("failed to count kept alive VMs: %s\n", err)
+		} else if keptAlive >= env.KeepAliveMaxPerProject {
+			log.Warnf("project already has %d kept alive VMs on this runner host (max %d), VM will be terminated\n", keptAlive, env.KeepAliveMaxPerProject)
+			return false
+		}
+	}
+
+	job.JobURL = env.GitlabJobUrl
+	job.ProjectId = env.ProjectId
+	job.InstanceId = instance.Id
+	job.ControllerURL = env.ControllerURL
+	job.KeepAliveUntil = expiresAt
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = now
+	}
+	if err := store.Save(job); err != nil {
+		log.Warnf("failed to record kept alive VM, VM will be terminated: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// keptAliveInstance returns the instance the run stage kept alive, and until when
+func keptAliveInstance(env gitlab.Environment, store *state.Store, instances []*ankacloud.Instance) (*ankacloud.Instance, time.Time) {
+	if store == nil {
+		// nothing was recorded, and the VM does not expire
+		return ankacloud.SelectUsableInstance(instances), time.Time{}
+	}
+
+	job, ok, err := store.Load(env.GitlabJobUrl)
+	if err != nil {
+		log.Warnf("%s\n", err)
+	}
+	if !ok || !job.IsKeptAlive(time.Now()) {
+		return nil, time.Time{}
+	}
+	for _, instance := range instances {
+		if instance.Id == job.InstanceId {
+			return instance, job.KeepAliveUntil
+		}
+	}
+	return nil, time.Time{}
+}
+
+func countKeptAlive(store *state.Store, projectId string, jobURL string, now time.Time) (int, error) {
+	jobs, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, job := range jobs {
+		if job.JobURL != jobURL && job.ProjectId == projectId && job.IsKeptAlive(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// releaseExpiredKeepAlives terminates kept alive VMs whose expiry passed. It runs on every cleanup,
+// so expiry is enforced even without a reap cron job. Failures are only logged.
+func releaseExpiredKeepAlives(ctx context.Context, backend Backend, store *state.Store, controllerURL string) {
+	jobs, err := store.List()
+	if err != nil {
+		log.Debugf("failed to list state dir: %s\n", err)
+		return
+	}
+
+	now := time.Now()
+	for _, job := range jobs {
+		if !job.KeepAliveExpired(now) || (job.ControllerURL != "" && job.ControllerURL != controllerURL) {
+			continue
+		}
+
+		log.Printf("releasing VM of job %s (instance %s), kept alive until %s\n", job.JobURL, job.InstanceId, job.KeepAliveUntil.Format(time.RFC3339))
+		if err := backend.TerminateInstance(ctx, ankacloud.TerminateInstanceRequest{Id: job.InstanceId}); err != nil {
+			log.Warnf("failed to release kept alive instance %s: %s\n", job.InstanceId, err)
+			continue
+		}
+		if err := store.Remove(job.JobURL); err != nil {
+			log.Warnf("%s\n", err)
+		}
+	}
+}
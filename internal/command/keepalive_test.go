@@ -0,0 +1,112 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
+)
+
+func TestKeptAliveInstance(t *testing.T) {
+	const jobURL = "https://gitlab.example.com/group/project/-/jobs/1"
+	instances := []*ankacloud.Instance{
+		{Id: "terminated", State: ankacloud.StateTerminated},
+		{Id: "kept", State: ankacloud.StateStarted},
+	}
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		job      *state.Job
+		expected string
+	}{
+		{"not recorded", nil, ""},
+		{"kept alive", &state.Job{JobURL: jobURL, InstanceId: "kept", KeepAliveUntil: until}, "kept"},
+		{"expired", &state.Job{JobURL: jobURL, InstanceId: "kept", KeepAliveUntil: time.Now().Add(-time.Minute)}, ""},
+		{"other instance", &state.Job{JobURL: jobURL, InstanceId: "other", KeepAliveUntil: until}, ""},
+		{"not kept alive", &state.Job{JobURL: jobURL, InstanceId: "kept"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := state.NewStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.job != nil {
+				if err := store.Save(*tt.job); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			instance, expiresAt := keptAliveInstance(gitlab.Environment{GitlabJobUrl: jobURL}, store, instances)
+			id := ""
+			if instance != nil {
+				id = instance.Id
+			}
+			if id != tt.expected {
+				t.Fatalf("expected kept alive instance %q, got %q", tt.expected, id)
+			}
+			if id != "" && !expiresAt.Equal(until) {
+				t.Errorf("expected expiry %s, got %s", until, expiresAt)
+			}
+		})
+	}
+
+	if instance, _ := keptAliveInstance(gitlab.Environment{GitlabJobUrl: jobURL}, nil, instances); instance == nil || instance.Id != "kept" {
+		t.Errorf("expected the usable instance to be kept alive without a state dir, got %+v", instance)
+	}
+}
+
+func TestCountKeptAlive(t *testing.T) {
+	store, err := state.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, job := range []state.Job{
+		{JobURL: "https://gitlab.example.com/a/-/jobs/1", ProjectId: "1", KeepAliveUntil: now.Add(time.Hour)},
+		{JobURL: "https://gitlab.example.com/a/-/jobs/2", ProjectId: "1", KeepAliveUntil: now.Add(-time.Hour)},
+		{JobURL: "https://gitlab.example.com/a/-/jobs/3", ProjectId: "1"},
+		{JobURL: "https://gitlab.example.com/b/-/jobs/4", ProjectId: "2", KeepAliveUntil: now.Add(time.Hour)},
+		{JobURL: "https://gitlab.example.com/a/-/jobs/5", ProjectId: "1", KeepAliveUntil: now.Add(time.Hour)},
+	} {
+		if err := store.Save(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := countKeptAlive(store, "1", "https://gitlab.example.com/a/-/jobs/5", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 other kept alive VM of the project, got %d", count)
+	}
+}
+
+func TestRecordKeptAlive(t *testing.T) {
+	store, err := state.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := gitlab.Environment{ProjectId: "1", KeepAliveMaxPerProject: 1, GitlabJobUrl: "https://gitlab.example.com/group/project/-/jobs/1"}
+	now := time.Now()
+
+	if !recordKeptAlive(env, store, &ankacloud.Instance{Id: "first"}, now, now.Add(time.Hour)) {
+		t.Fatal("expected the first VM of the project to be kept alive")
+	}
+	// the lock is released once recorded, not when the instructions are printed
+	unlock, err := store.Lock()
+	if err != nil {
+		t.Fatalf("expected the state lock to be released, got %v", err)
+	}
+	unlock()
+
+	env.GitlabJobUrl = "https://gitlab.example.com/group/project/-/jobs/2"
+	if recordKeptAlive(env, store, &ankacloud.Instance{Id: "second"}, now, now.Add(time.Hour)) {
+		t.Error("expected the second VM of the project to exceed the cap")
+	}
+}
@@ -5,11 +5,16 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/audit"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/webhook"
 )
 
 var prepareCommand = &cobra.Command{
@@ -24,40 +29,64 @@ var prepareCommand = &cobra.Command{
 	},
 }
 
-func executePrepare(ctx context.Context, env gitlab.Environment) error {
+func executePrepare(ctx context.Context, env gitlab.Environment) (err error) {
 	log.SetOutput(os.Stderr)
 	log.Debugln("running prepare stage")
 
-	apiClientConfig := getAPIClientConfig(env)
-	apiClient, err := ankacloud.NewAPIClient(apiClientConfig)
+	// what is known of the instance when prepare fails, for the failure webhook
+	failed := webhookInstance(env, nil)
+	defer func() {
+		if err != nil {
+			webhook.Send(ctx, webhook.Payload{Event: webhook.EventFailed, Instance: failed, Error: err.Error()})
+		}
+	}()
+
+	backend, backendURL, err := selectBackend(ctx, env)
 	if err != nil {
-		return gitlab.TransientError(fmt.Errorf("failed to initialize API client with config +%v: %w", apiClientConfig, err))
+		return gitlab.TransientError(err)
 	}
-	controller := ankacloud.NewController(apiClient)
+	if len(env.ControllerURLs) > 1 || env.Backend == gitlab.BackendNode {
+		log.Colorf("using %s %s\n", env.Backend, backendURL)
+	}
+	env.ControllerURL = backendURL
+	metrics.Update(func(l *metrics.Labels) { l.Controller = backendURL })
+	failed.Controller = backendURL
 
 	var template string
+	resolveStart := time.Now()
 	templateId := env.TemplateId
 	if templateId == "" {
 		if env.TemplateName == "" {
 			return fmt.Errorf("%w: either template id or template name must be specified", gitlab.ErrMissingVar)
 		}
 		log.Warnln("please consider using template id instead of template name as template names are not guaranteed to be unique")
-		templateId, err = controller.GetTemplateIdByName(ctx, env.TemplateName)
+		section := log.StartSection("template", "Resolving template %q", env.TemplateName)
+		templateId, err = backend.GetTemplateIdByName(ctx, env.TemplateName)
 		if err != nil {
-			return fmt.Errorf("failed to get template id of template named %q: %w", env.TemplateName, err)
+			section.End("failed to resolve template %q", env.TemplateName)
+			return controllerFailure(fmt.Errorf("failed to get template id of template named %q: %w", env.TemplateName, err))
 		}
-		log.Colorf("template with id %q and name %q will be used\n", templateId, env.TemplateName)
+		section.End("template with id %q and name %q will be used", templateId, env.TemplateName)
 		template = env.TemplateName
+		audit.Record(audit.Event{Action: audit.ActionTemplateResolved, TemplateId: templateId, Message: env.TemplateName, Duration: time.Since(resolveStart).Milliseconds()})
 	} else {
 		template = templateId
 	}
+	audit.Update(func(e *audit.Event) {
+		e.TemplateId = templateId
+		e.Tag = env.TemplateTag
+	})
+	failed.TemplateId = templateId
+
+	priority := env.ResolvePriority(time.Now())
+	log.Colorf("using %s\n", priority)
 
 	req := ankacloud.CreateInstanceRequest{
 		TemplateId:              templateId,
 		ExternalId:              env.GitlabJobUrl,
 		Tag:                     env.TemplateTag,
 		NodeId:                  env.NodeId,
-		Priority:                env.Priority,
+		Priority:                priority.Priority,
 		NodeGroupId:             env.NodeGroupId,
 		StartupScriptCondition:  ankacloud.WaitForNetwork,
 		StartupScriptMonitoring: true,
@@ -65,6 +94,7 @@ func executePrepare(ctx context.Context, env gitlab.Environment) error {
 		StartupScript:           base64.StdEncoding.EncodeToString([]byte("sleep 5")), // even though we wait for network, it is recommended to wait a bit more
 		Vcpu:                    env.VmVcpu,
 		VramMb:                  env.VmVramMb,
+		Metadata:                map[string]string{createdByKey: createdByValue},
 	}
 
 	var tagName string
@@ -74,18 +104,46 @@ func executePrepare(ctx context.Context, env gitlab.Environment) error {
 	}
 
 	log.Colorf("Creating macOS VM with Template %q and Tag %q -- please be patient...", template, tagName)
-	log.Debugf("payload %+v\n", req)
-	instanceId, err := controller.CreateInstance(ctx, req)
+	log.Debugf("creating instance of template %s, tag %q, node group %q, priority %d\n", req.TemplateId, req.Tag, req.NodeGroupId, req.Priority)
+	createStart := time.Now()
+	instanceId, err := backend.CreateInstance(ctx, req)
 	if err != nil {
-		return gitlab.TransientError(fmt.Errorf("failed to create instance: %w", err))
+		return controllerFailure(fmt.Errorf("failed to create instance: %w", err))
 	}
+	audit.Update(func(e *audit.Event) { e.InstanceId = instanceId })
+	failed.Id = instanceId
+	audit.Record(audit.Event{Action: audit.ActionInstanceCreated, Duration: time.Since(createStart).Milliseconds()})
 
-	instance, err := controller.WaitForInstanceToBeScheduled(ctx, instanceId)
+	if store := getStateStore(env); store != nil {
+		err := store.Save(state.Job{
+			JobURL:        env.GitlabJobUrl,
+			ProjectId:     env.ProjectId,
+			InstanceId:    instanceId,
+			ControllerURL: env.ControllerURL,
+			TemplateId:    templateId,
+			CreatedAt:     time.Now(),
+		})
+		if err != nil {
+			log.Warnf("failed to record instance %s in state dir: %s\n", instanceId, err)
+		}
+	}
+
+	instance, err := backend.WaitForInstanceToBeScheduled(ctx, instanceId)
 	if err != nil {
-		return gitlab.TransientError(fmt.Errorf("failed to wait for instance %q to be scheduled: %w", instanceId, err))
+		return controllerFailure(fmt.Errorf("failed to wait for instance %q to be scheduled: %w", instanceId, err))
 	}
 
+	audit.Update(func(e *audit.Event) {
+		e.NodeId = instance.NodeId
+		e.NodeName = instance.Node.Name
+	})
+	audit.Record(audit.Event{Action: audit.ActionInstanceReady, Duration: time.Since(createStart).Milliseconds()})
+
 	log.Colorf("VM %s (%s) is ready for work on node %s (%s)\n", instance.VMInfo.Name, instance.Id, instance.Node.Name, instance.Node.IP)
 
+	provisioned := webhookInstance(env, instance)
+	provisioned.TemplateId = templateId
+	webhook.Send(ctx, webhook.Payload{Event: webhook.EventProvisioned, Instance: provisioned})
+
 	return nil
 }
@@ -0,0 +1,374 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
+)
+
+type reapOptions struct {
+	controllerURL      string
+	caCertPath         string
+	caCertPEM          string
+	clientCertPath     string
+	clientCertPEM      string
+	clientCertKeyPath  string
+	clientCertKeyPEM   string
+	clientCertP12Path  string
+	passphrasePath     string
+	tlsMinVersion      string
+	tlsCipherSuites    []string
+	tlsPins            []string
+	skipTLSVerify      bool
+	uakCredentialsPath string
+	oauth              gitlab.OAuth
+	proxyURL           string
+	noProxy            string
+	gitlabURL          string
+	gitlabTokenPath    string
+	stateDir           string
+	ttl                time.Duration
+	interval           time.Duration
+	dryRun             bool
+	debug              bool
+	release            []string
+}
+
+var reapOpts reapOptions
+
+var reapCommand = &cobra.Command{
+	Use:   "reap",
+	Short: "Terminate instances left behind by jobs that ended or exceeded their TTL",
+	Long: `Terminate instances created by this executor whose cleanup never ran.
+Instances are recognized by the metadata the executor tags them with, or by the runner host state dir.
+An instance is terminated when its Gitlab job has finished or when it is older than the TTL.
+Runs once by default, or continuously when --interval is set.`,
+	// reap runs outside of a Gitlab job (cron, daemon), so there is no job environment to load
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if reapOpts.debug {
+			log.SetLevel(log.LevelDebug)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return executeReap(cmd.Context(), reapOpts)
+	},
+}
+
+func init() {
+	flags := reapCommand.Flags()
+	flags.StringVar(&reapOpts.controllerURL, "controller-url", os.Getenv("ANKA_CLOUD_CONTROLLER_URL"), "Anka Build Cloud Controller URL, including http[s] prefix")
+	flags.StringVar(&reapOpts.caCertPath, "ca-cert-path", "", "CA cert used to validate the Controller certificate")
+	flags.StringVar(&reapOpts.caCertPEM, "ca-cert-pem", os.Getenv("ANKA_CLOUD_CA_CERT_PEM"), "inline PEM CA cert(s), instead of --ca-cert-path")
+	flags.StringVar(&reapOpts.clientCertPath, "client-cert-path", "", "client certificate used for Controller cert authentication")
+	flags.StringVar(&reapOpts.clientCertPEM, "client-cert-pem", os.Getenv("ANKA_CLOUD_CLIENT_CERT_PEM"), "inline PEM client certificate, instead of --client-cert-path")
+	flags.StringVar(&reapOpts.clientCertKeyPath, "client-cert-key-path", "", "client certificate key used for Controller cert authentication")
+	// the key is read from the environment by default, keeping it out of the process list
+	flags.StringVar(&reapOpts.clientCertKeyPEM, "client-cert-key-pem", os.Getenv("ANKA_CLOUD_CLIENT_CERT_KEY_PEM"), "inline PEM client certificate key, instead of --client-cert-key-path (defaults to ANKA_CLOUD_CLIENT_CERT_KEY_PEM, prefer it over the flag)")
+	flags.StringVar(&reapOpts.clientCertP12Path, "client-cert-p12-path", "", "PKCS#12 bundle with the client certificate and key, instead of PEM files")
+	flags.StringVar(&reapOpts.passphrasePath, "client-cert-passphrase-path", "", "file containing the passphrase of the PKCS#12 bundle or encrypted client certificate key")
+	flags.StringVar(&reapOpts.tlsMinVersion, "tls-min-version", "", "minimum TLS version toward the Controller: 1.0, 1.1, 1.2 (default) or 1.3")
+	flags.StringSliceVar(&reapOpts.tlsCipherSuites, "tls-cipher-suites", nil, "cipher suites allowed for TLS 1.2 and lower, by their Go names")
+	flags.StringSliceVar(&reapOpts.tlsPins, "tls-pins", nil, "SPKI SHA-256 pins, one of which the Controller certificate chain must match")
+	flags.BoolVar(&reapOpts.skipTLSVerify, "skip-tls-verify", false, "skip Controller certificate validation")
+	flags.StringVar(&reapOpts.uakCredentialsPath, "uak-credentials-path", "", "file with the Controller API key (UAK) credentials")
+	flags.StringVar(&reapOpts.oauth.TokenURL, "oauth-token-url", "", "OAuth2 token endpoint used to get Controller tokens with the client credentials grant")
+	flags.StringVar(&reapOpts.oauth.ClientId, "oauth-client-id", "", "OAuth2 client id")
+	flags.StringVar(&reapOpts.oauth.ClientSecretPath, "oauth-client-secret-path", "", "file containing the OAuth2 client secret")
+	flags.StringSliceVar(&reapOpts.oauth.Scopes, "oauth-scopes", nil, "OAuth2 scopes to request")
+	flags.StringVar(&reapOpts.proxyURL, "proxy-url", "", "http, https or socks5 proxy used to reach the Controller")
+	flags.StringVar(&reapOpts.noProxy, "no-proxy", "", "comma separated hosts reached without the proxy")
+	flags.StringVar(&reapOpts.gitlabURL, "gitlab-url", "", "only consider jobs of this Gitlab instance, and use it as the Gitlab API base URL (required with --gitlab-token-path)")
+	flags.StringVar(&reapOpts.gitlabTokenPath, "gitlab-token-path", "", "file containing a Gitlab token with read_api scope, used to check job status")
+	flags.StringVar(&reapOpts.stateDir, "state-dir", "", "the runner host state dir (same as ANKA_CLOUD_STATE_DIR)")
+	flags.DurationVar(&reapOpts.ttl, "ttl", 0, "terminate instances older than this, regardless of job status (0 disables)")
+	flags.DurationVar(&reapOpts.interval, "interval", 0, "run continuously, reaping every interval (0 runs once)")
+	flags.BoolVar(&reapOpts.dryRun, "dry-run", false, "report what would be terminated without terminating")
+	flags.BoolVar(&reapOpts.debug, "debug", false, "output debug info")
+	flags.StringSliceVar(&reapOpts.release, "release", nil, "terminate these instance ids right away (e.g. VMs kept alive on error), then exit")
+}
+
+type reapSummary struct {
+	dryRun     bool
+	scanned    int
+	owned      int
+	terminated []string
+	kept       int
+	failed     []string
+}
+
+func (s reapSummary) String() string {
+	terminated := "terminated"
+	if s.dryRun {
+		terminated = "would be terminated"
+	}
+	return fmt.Sprintf("scanned %d instances, %d created by this executor: %d %s, %d kept, %d failed",
+		s.scanned, s.owned, len(s.terminated), terminated, s.kept, len(s.failed))
+}
+
+func executeReap(ctx context.Context, opts reapOptions) error {
+	opts.controllerURL = strings.TrimSuffix(opts.controllerURL, "/")
+	if strings.Contains(opts.controllerURL, ",") {
+		return fmt.Errorf("%w: --controller-url takes a single Controller, run one reaper per Controller", gitlab.ErrInvalidVar)
+	}
+	if !strings.HasPrefix(opts.controllerURL, "http") {
+		return fmt.Errorf("%w: --controller-url must be set, including http[s] prefix", gitlab.ErrInvalidVar)
+	}
+
+	// the journal tells which instances are the executor's, not whether their job ended
+	if len(opts.release) == 0 && opts.ttl == 0 && opts.gitlabTokenPath == "" {
+		return fmt.Errorf("%w: nothing to decide on, --ttl and/or --gitlab-token-path must be set", gitlab.ErrInvalidVar)
+	}
+	// the token only goes to this Gitlab, never to the host of an instance external id
+	if opts.gitlabTokenPath != "" && opts.gitlabURL == "" {
+		return fmt.Errorf("%w: --gitlab-url is required with --gitlab-token-path", gitlab.ErrInvalidVar)
+	}
+
+	apiClientConfig := getAPIClientConfig(gitlab.Environment{
+		ControllerURL:            opts.controllerURL,
+		CaCertPath:               opts.caCertPath,
+		CaCertPEM:                opts.caCertPEM,
+		ClientCertPath:           opts.clientCertPath,
+		ClientCertPEM:            opts.clientCertPEM,
+		ClientCertKeyPath:        opts.clientCertKeyPath,
+		ClientCertKeyPEM:         opts.clientCertKeyPEM,
+		ClientCertP12Path:        opts.clientCertP12Path,
+		ClientCertPassphrasePath: opts.passphrasePath,
+		TLSMinVersion:            opts.tlsMinVersion,
+		TLSCipherSuites:          opts.tlsCipherSuites,
+		TLSPins:                  opts.tlsPins,
+		SkipTLSVerify:            opts.skipTLSVerify,
+		UAKCredentialsPath:       opts.uakCredentialsPath,
+		OAuth:                    opts.oauth,
+		ProxyURL:                 opts.proxyURL,
+		NoProxy:                  opts.noProxy,
+		StateDir:                 opts.stateDir,
+	})
+	apiClient, err := ankacloud.NewAPIClient(apiClientConfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize API client: %w", err)
+	}
+	controller := ankacloud.NewController(apiClient)
+
+	var jobsClient *gitlab.APIClient
+	if opts.gitlabTokenPath != "" {
+		token, err := os.ReadFile(opts.gitlabTokenPath)
+		if err != nil {
+			return fmt.Errorf("failed to read gitlab token from %q: %w", opts.gitlabTokenPath, err)
+		}
+		log.RegisterSecret(string(token))
+		jobsClient = gitlab.NewAPIClient(opts.gitlabURL, strings.TrimSpace(string(token)))
+	}
+
+	var store *state.Store
+	if opts.stateDir != "" {
+		store, err = state.NewStore(opts.stateDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(opts.release) > 0 {
+		return releaseInstances(ctx, controller, store, opts)
+	}
+
+	for {
+		summary, err := reapOnce(ctx, controller, jobsClient, store, opts)
+		if err == nil {
+			log.Println(summary)
+		}
+
+		if opts.interval == 0 {
+			if err == nil && len(summary.failed) > 0 {
+				return fmt.Errorf("failed to terminate instances: %s", strings.Join(summary.failed, ", "))
+			}
+			return err
+		}
+
+		if err != nil {
+			log.Errorf("reap failed: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(opts.interval):
+		}
+	}
+}
+
+func reapOnce(ctx context.Context, controller *ankacloud.Controller, jobsClient *gitlab.APIClient, store *state.Store, opts reapOptions) (reapSummary, error) {
+	summary := reapSummary{dryRun: opts.dryRun}
+
+	// instances created after the listing are missing from it, their journal entries are not stale
+	listedAt := time.Now()
+	instances, err := controller.GetAllInstances(ctx)
+	if err != nil {
+		return summary, err
+	}
+	summary.scanned = len(instances)
+
+	journal := map[string]state.Job{}
+	if store != nil {
+		jobs, err := store.List()
+		if err != nil {
+			return summary, err
+		}
+		for _, job := range jobs {
+			if job.ControllerURL != "" && job.ControllerURL != opts.controllerURL {
+				continue
+			}
+			journal[job.InstanceId] = job
+		}
+	}
+
+	live := map[string]bool{}
+	for _, instance := range instances {
+		live[instance.Id] = true
+		if instance.State == ankacloud.StateTerminating || instance.State == ankacloud.StateTerminated {
+			continue
+		}
+
+		job, journaled := journal[instance.Id]
+		if !journaled && !reapable(instance, opts) {
+			continue
+		}
+		summary.owned++
+
+		reason := reapReason(ctx, instance, job, journaled, jobsClient, opts)
+		if reason == "" {
+			summary.kept++
+			continue
+		}
+
+		if opts.dryRun {
+			log.Printf("would terminate instance %s of job %s: %s\n", instance.Id, instance.ExternalId, reason)
+			summary.terminated = append(summary.terminated, instance.Id)
+			continue
+		}
+
+		log.Printf("terminating instance %s of job %s: %s\n", instance.Id, instance.ExternalId, reason)
+		if err := controller.TerminateInstance(ctx, ankacloud.TerminateInstanceRequest{Id: instance.Id}); err != nil {
+			log.Errorf("failed to terminate instance %s: %s\n", instance.Id, err)
+			summary.failed = append(summary.failed, instance.Id)
+			continue
+		}
+		summary.terminated = append(summary.terminated, instance.Id)
+
+		if journaled {
+			if err := store.Remove(job.JobURL); err != nil {
+				log.Warnf("%s\n", err)
+			}
+		}
+	}
+
+	// entries of instances the controller no longer knows about are stale
+	if store != nil && !opts.dryRun {
+		for instanceId, job := range journal {
+			if !live[instanceId] && job.CreatedAt.Before(listedAt) {
+				log.Debugf("removing stale state of job %s (instance %s)\n", job.JobURL, instanceId)
+				if err := store.Remove(job.JobURL); err != nil {
+					log.Warnf("%s\n", err)
+				}
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+func releaseInstances(ctx context.Context, controller *ankacloud.Controller, store *state.Store, opts reapOptions) error {
+	var jobs []state.Job
+	if store != nil {
+		var err error
+		if jobs, err = store.List(); err != nil {
+			return err
+		}
+	}
+
+	var failed []string
+	for _, instanceId := range opts.release {
+		if opts.dryRun {
+			log.Printf("would terminate instance %s\n", instanceId)
+			continue
+		}
+
+		log.Printf("terminating instance %s\n", instanceId)
+		if err := controller.TerminateInstance(ctx, ankacloud.TerminateInstanceRequest{Id: instanceId}); err != nil {
+			log.Errorf("failed to terminate instance %s: %s\n", instanceId, err)
+			failed = append(failed, instanceId)
+			continue
+		}
+
+		for _, job := range jobs {
+			if job.InstanceId == instanceId {
+				if err := store.Remove(job.JobURL); err != nil {
+					log.Warnf("%s\n", err)
+				}
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to terminate instances: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// reapable tells if an instance the journal does not know about was created by the executor, for a job
+// of the Gitlab instance reaped for
+func reapable(instance ankacloud.Instance, opts reapOptions) bool {
+	if !createdByExecutor(instance) {
+		return false
+	}
+	_, err := gitlab.ParseJobURL(instance.ExternalId, opts.gitlabURL)
+	return err == nil
+}
+
+// reapReason returns why the instance should be terminated, or an empty string if it should be kept.
+func reapReason(ctx context.Context, instance ankacloud.Instance, job state.Job, journaled bool, jobsClient *gitlab.APIClient, opts reapOptions) string {
+	// a VM kept alive on error has a failed job and may be older than the TTL, its expiry is what counts
+	if journaled && !job.KeepAliveUntil.IsZero() {
+		if job.KeepAliveExpired(time.Now()) {
+			return fmt.Sprintf("kept alive on error until %s", job.KeepAliveUntil.Format(time.RFC3339))
+		}
+		return ""
+	}
+
+	createdAt, ok := instance.CreatedAt()
+	if !ok && journaled {
+		createdAt, ok = job.CreatedAt, !job.CreatedAt.IsZero()
+	}
+
+	if opts.ttl > 0 && ok {
+		if age := time.Since(createdAt); age > opts.ttl {
+			return fmt.Sprintf("age %s exceeds TTL of %s", age.Round(time.Second), opts.ttl)
+		}
+	}
+
+	if jobsClient != nil {
+		jobURL := instance.ExternalId
+		if journaled {
+			jobURL = job.JobURL
+		}
+		status, err := jobsClient.GetJobStatus(ctx, jobURL)
+		if err != nil {
+			log.Warnf("failed to get status of job %s, keeping instance %s: %s\n", jobURL, instance.Id, err)
+			return ""
+		}
+		log.Debugf("job %s of instance %s is %s\n", jobURL, instance.Id, status)
+		if status.IsFinished() {
+			return fmt.Sprintf("job is %s", status)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,137 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
+)
+
+func TestReapReason(t *testing.T) {
+	gitlabServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/projects/group%2Fproject/jobs/1", "/api/v4/projects/group/project/jobs/1":
+			w.Write([]byte(`{"status": "success"}`))
+		case "/api/v4/projects/group%2Fproject/jobs/2", "/api/v4/projects/group/project/jobs/2":
+			w.Write([]byte(`{"status": "running"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gitlabServer.Close()
+	jobsClient := gitlab.NewAPIClient(gitlabServer.URL, "token")
+
+	finishedJob := gitlabServer.URL + "/group/project/-/jobs/1"
+	runningJob := gitlabServer.URL + "/group/project/-/jobs/2"
+	unknownJob := gitlabServer.URL + "/group/project/-/jobs/3"
+	old := time.Now().Add(-48 * time.Hour).Format(time.RFC3339Nano)
+	recent := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+
+	tests := []struct {
+		name       string
+		instance   ankacloud.Instance
+		job        state.Job
+		journaled  bool
+		ttl        time.Duration
+		jobsClient *gitlab.APIClient
+		reaped     bool
+	}{
+		{name: "older than TTL", instance: ankacloud.Instance{ExternalId: runningJob, CreationTime: old}, ttl: 24 * time.Hour, reaped: true},
+		{name: "younger than TTL", instance: ankacloud.Instance{ExternalId: runningJob, CreationTime: recent}, ttl: 24 * time.Hour},
+		{name: "TTL without creation time", instance: ankacloud.Instance{ExternalId: runningJob}, ttl: 24 * time.Hour},
+		{name: "TTL from journal", instance: ankacloud.Instance{ExternalId: runningJob}, job: state.Job{JobURL: runningJob, CreatedAt: time.Now().Add(-48 * time.Hour)}, journaled: true, ttl: 24 * time.Hour, reaped: true},
+		{name: "finished job", instance: ankacloud.Instance{ExternalId: finishedJob, CreationTime: recent}, jobsClient: jobsClient, reaped: true},
+		{name: "running job", instance: ankacloud.Instance{ExternalId: runningJob, CreationTime: recent}, jobsClient: jobsClient},
+		{name: "failing jobs API", instance: ankacloud.Instance{ExternalId: unknownJob, CreationTime: recent}, jobsClient: jobsClient},
+		{name: "journaled job URL", instance: ankacloud.Instance{ExternalId: runningJob}, job: state.Job{JobURL: finishedJob}, journaled: true, jobsClient: jobsClient, reaped: true},
+		{name: "kept alive", instance: ankacloud.Instance{ExternalId: finishedJob, CreationTime: old}, job: state.Job{JobURL: finishedJob, KeepAliveUntil: time.Now().Add(time.Hour)}, journaled: true, ttl: 24 * time.Hour, jobsClient: jobsClient},
+		{name: "keep alive expired", instance: ankacloud.Instance{ExternalId: runningJob, CreationTime: recent}, job: state.Job{JobURL: runningJob, KeepAliveUntil: time.Now().Add(-time.Minute)}, journaled: true, reaped: true},
+		{name: "no TTL nor jobs API", instance: ankacloud.Instance{ExternalId: finishedJob, CreationTime: old}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := reapReason(context.Background(), tt.instance, tt.job, tt.journaled, tt.jobsClient, reapOptions{ttl: tt.ttl})
+			if tt.reaped != (reason != "") {
+				t.Errorf("expected reaped %v, got reason %q", tt.reaped, reason)
+			}
+		})
+	}
+}
+
+func TestReapable(t *testing.T) {
+	created := map[string]string{createdByKey: createdByValue}
+
+	tests := []struct {
+		name      string
+		instance  ankacloud.Instance
+		gitlabURL string
+		expected  bool
+	}{
+		{"created by the executor", ankacloud.Instance{ExternalId: "https://gitlab.example.com/group/project/-/jobs/1", Metadata: created}, "", true},
+		{"job URL of another tool", ankacloud.Instance{ExternalId: "https://gitlab.example.com/group/project/-/jobs/1"}, "", false},
+		{"created by another tool", ankacloud.Instance{ExternalId: "https://gitlab.example.com/group/project/-/jobs/1", Metadata: map[string]string{createdByKey: "other"}}, "", false},
+		{"not a job URL", ankacloud.Instance{ExternalId: "build-42", Metadata: created}, "", false},
+		{"matching Gitlab", ankacloud.Instance{ExternalId: "https://gitlab.example.com/group/project/-/jobs/1", Metadata: created}, "https://gitlab.example.com", true},
+		{"other Gitlab", ankacloud.Instance{ExternalId: "https://gitlab.example.com/group/project/-/jobs/1", Metadata: created}, "https://gitlab.other.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reapable(tt.instance, reapOptions{gitlabURL: tt.gitlabURL}); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestReapRequiresDecision(t *testing.T) {
+	err := executeReap(context.Background(), reapOptions{controllerURL: "http://controller", stateDir: t.TempDir()})
+	if !errors.Is(err, gitlab.ErrInvalidVar) {
+		t.Errorf("expected state dir alone to be rejected, got %v", err)
+	}
+
+	err = executeReap(context.Background(), reapOptions{controllerURL: "http://controller", gitlabTokenPath: "/etc/anka-gle/gitlab-token"})
+	if !errors.Is(err, gitlab.ErrInvalidVar) {
+		t.Errorf("expected a Gitlab token without --gitlab-url to be rejected, got %v", err)
+	}
+}
+
+func TestReapKeepsJournalOfNewInstances(t *testing.T) {
+	store, err := state.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const goneJob = "https://gitlab.example.com/group/project/-/jobs/1"
+	const newJob = "https://gitlab.example.com/group/project/-/jobs/2"
+	if err := store.Save(state.Job{JobURL: goneJob, InstanceId: "gone", CreatedAt: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a job prepares its instance while the controller is being listed
+		if err := store.Save(state.Job{JobURL: newJob, InstanceId: "new", CreatedAt: time.Now()}); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"status": "OK", "body": []}`))
+	}))
+	defer server.Close()
+
+	controller := ankacloud.NewController(&ankacloud.APIClient{ControllerURL: server.URL, HttpClient: server.Client()})
+	if _, err := reapOnce(context.Background(), controller, nil, store, reapOptions{controllerURL: server.URL, ttl: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := store.Load(goneJob); ok {
+		t.Error("expected the journal entry of the gone instance to be removed")
+	}
+	if _, ok, _ := store.Load(newJob); !ok {
+		t.Error("expected the journal entry of the instance created during the listing to be kept")
+	}
+}
@@ -3,10 +3,18 @@ package command
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/audit"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/version"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/webhook"
 )
 
 type contextKey string
@@ -15,21 +23,133 @@ var rootCmd = &cobra.Command{
 	Use:           "anka-gle",
 	SilenceUsage:  true,
 	SilenceErrors: true,
+	// Gitlab stages get their configuration from the job environment. Commands running
+	// outside of a job (like reap) override this hook.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		env, err := gitlab.InitEnv()
+		if err != nil {
+			return fmt.Errorf("failed to initialize environment: %s", err)
+		}
+
+		log.SetLevel(env.LogLevel)
+		for component, level := range env.LogComponentLevels {
+			log.SetComponentLevel(component, level)
+		}
+		log.SetColor(env.LogColor)
+		registerSecrets(env)
+
+		audit.Init(audit.Config{
+			Path:     env.AuditLog.Path,
+			MaxSize:  int64(env.AuditLog.MaxSizeMb) * 1024 * 1024,
+			MaxFiles: env.AuditLog.MaxFiles,
+		}, audit.Event{
+			Stage:      cmd.Name(),
+			JobURL:     env.GitlabJobUrl,
+			ProjectId:  env.ProjectId,
+			PipelineId: env.PipelineId,
+			Backend:    env.Backend,
+		})
+		audit.StartStage()
+
+		template := env.TemplateId
+		if template == "" {
+			template = env.TemplateName
+		}
+		metrics.Init(metrics.Config{
+			TextfileDir: env.Metrics.TextfileDir,
+			PushURL:     env.Metrics.PushURL,
+			StateDir:    env.StateDir,
+		}, metrics.Labels{
+			Template:   template,
+			NodeGroup:  env.NodeGroupId,
+			Controller: env.ControllerURL,
+		})
+
+		initWebhooks(cmd, env)
+
+		ctx := tracing.Init(cmd.Context(), tracing.Config{
+			Endpoint: env.Tracing.OTLPEndpoint,
+			Headers:  env.Tracing.OTLPHeaders,
+			File:     env.Tracing.File,
+			Dir:      env.StateDir,
+			Version:  version.Get(),
+		}, env.GitlabJobUrl, cmd.Name())
+
+		cmd.SetContext(context.WithValue(ctx, contextKey("env"), env))
+		return nil
+	},
+}
+
+// initWebhooks sets up the lifecycle webhooks. A secret that can't be read, or is empty, leaves them
+// off with a warning, as payloads are never sent unsigned.
+func initWebhooks(cmd *cobra.Command, env gitlab.Environment) {
+	config := webhook.Config{
+		URLs:     env.Webhooks.URLs,
+		Timeout:  env.Webhooks.Timeout,
+		Attempts: env.Webhooks.Attempts,
+	}
+	if len(config.URLs) > 0 {
+		secret, err := os.ReadFile(env.Webhooks.SecretPath)
+		config.Secret = strings.TrimRight(string(secret), "\r\n")
+		switch {
+		case err != nil:
+			log.Warnf("webhooks are disabled, failed to read webhook secret: %s\n", err)
+			config.URLs = nil
+		case config.Secret == "":
+			log.Warnf("webhooks are disabled, webhook secret %s is empty\n", env.Webhooks.SecretPath)
+			config.URLs = nil
+		}
+		log.RegisterSecret(config.Secret)
+	}
+	webhook.Init(config, webhook.Job{
+		URL:        env.GitlabJobUrl,
+		ProjectId:  env.ProjectId,
+		PipelineId: env.PipelineId,
+		Stage:      cmd.Name(),
+	})
+}
+
+// registerSecrets keeps credentials from the job configuration out of the job log, even with debug on
+func registerSecrets(env gitlab.Environment) {
+	log.RegisterSecret(env.SSHPassword, env.OAuth.IdToken, env.Node.Password)
+	for _, v := range env.CustomHttpHeaders {
+		log.RegisterSecret(v)
+	}
+	for _, v := range env.Tracing.OTLPHeaders {
+		log.RegisterSecret(v)
+	}
+	// an inline key is masked line by line, as it may be logged in parts
+	if env.ClientCertKeyPEM != "" {
+		log.RegisterSecret(env.ClientCertKeyPEM)
+		for _, line := range strings.Split(env.ClientCertKeyPEM, "\n") {
+			if !strings.HasPrefix(line, "-----") {
+				log.RegisterSecret(line)
+			}
+		}
+	}
+	if u, err := url.Parse(env.ProxyURL); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			log.RegisterSecret(password)
+		}
+	}
 }
 
 func init() {
-	rootCmd.AddCommand(cleanupCommand, prepareCommand, runCommand, configCommand)
+	rootCmd.AddCommand(cleanupCommand, prepareCommand, runCommand, configCommand, reapCommand)
 }
 
 func Execute(ctx context.Context) error {
-
-	env, err := gitlab.InitEnv()
+	cmd, err := rootCmd.ExecuteContextC(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to initialize environment: %s", err)
+		countError(cmd.Name(), err)
 	}
+	return err
+}
 
-	log.SetDebug(env.Debug)
-	log.SetQuietLogging(env.QuietLogging)
-
-	return rootCmd.ExecuteContext(context.WithValue(ctx, contextKey("env"), env))
+// countError counts the failed stage, unless the job script failed, which is the job's business
+// rather than a failure of the executor
+func countError(stage string, err error) {
+	if category := errorCategory(err); category != "script" {
+		metrics.Inc(metrics.ErrorsTotal, "stage", stage, "category", category)
+	}
 }
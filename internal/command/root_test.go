@@ -0,0 +1,35 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCountError(t *testing.T) {
+	dir := t.TempDir()
+	metrics.Init(metrics.Config{TextfileDir: dir}, metrics.Labels{Template: "macos-14"})
+	defer metrics.Init(metrics.Config{}, metrics.Labels{})
+
+	countError("run", fmt.Errorf("failed to execute script: %w", &ssh.ExitError{}))
+	countError("prepare", context.DeadlineExceeded)
+	metrics.Flush(context.Background())
+
+	data, err := os.ReadFile(filepath.Join(dir, "anka_cloud_gitlab_executor.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	if !strings.Contains(text, `category="canceled"`) {
+		t.Errorf("expected the canceled prepare stage to be counted in:\n%s", text)
+	}
+	if strings.Contains(text, `category="script"`) {
+		t.Errorf("expected the failed job script not to be counted in:\n%s", text)
+	}
+}
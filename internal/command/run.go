@@ -2,22 +2,23 @@ package command
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
 	"golang.org/x/crypto/ssh"
 )
 
-const (
-	defaultSshUserName = "anka"
-	defaultSshPassword = "admin"
-)
-
 var runCommand = &cobra.Command{
 	Use: "run",
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -30,39 +31,36 @@ var runCommand = &cobra.Command{
 	},
 }
 
-func executeRun(ctx context.Context, env gitlab.Environment, args []string) error {
+// stages Gitlab runs after a failure, whose own failures do not fail the job
+var afterFailureStages = []string{"after_script", "archive_cache_on_failure", "upload_artifacts_on_failure", "cleanup_file_variables"}
+
+func executeRun(ctx context.Context, env gitlab.Environment, args []string) (err error) {
 	log.SetOutput(os.Stderr)
 
 	log.Debugf("running run stage %s\n", args[1])
 
-	apiClientConfig := getAPIClientConfig(env)
-	apiClient, err := ankacloud.NewAPIClient(apiClientConfig)
+	store := getStateStore(env)
+	backend, backendURL, err := findJobBackend(ctx, env, store)
 	if err != nil {
-		return gitlab.TransientError(fmt.Errorf("failed to initialize API client with config +%v: %w", apiClientConfig, err))
+		return gitlab.TransientError(err)
 	}
+	log.Debugf("using %s %s\n", env.Backend, backendURL)
+	env.ControllerURL = backendURL
+	metrics.Update(func(l *metrics.Labels) { l.Controller = backendURL })
 
-	controller := ankacloud.NewController(apiClient)
-
-	instance, err := controller.GetInstanceByExternalId(ctx, env.GitlabJobUrl)
+	instance, err := getJobInstance(ctx, backend, store, env.GitlabJobUrl)
 	if err != nil {
-		return gitlab.TransientError(fmt.Errorf("failed to get instance by external id %q: %w", env.GitlabJobUrl, err))
+		return controllerFailure(fmt.Errorf("failed to get instance by external id %q: %w", env.GitlabJobUrl, err))
 	}
-
-	var nodeSshPort string
-	if instance.VMInfo == nil {
-		return gitlab.TransientError(fmt.Errorf("instance has no VM: %+v", instance))
+	fillTemplateId(store, env.GitlabJobUrl, instance)
+	if env.KeepAliveOnError && !slices.Contains(afterFailureStages, args[1]) {
+		defer func() {
+			if err != nil {
+				keepAliveOnError(ctx, env, backend, store, instance)
+			}
+		}()
 	}
 
-	for _, rule := range instance.VMInfo.PortForwardingRules {
-		if rule.VmPort == 22 && rule.Protocol == "tcp" {
-			nodeSshPort = fmt.Sprintf("%d", rule.NodePort)
-		}
-	}
-	if nodeSshPort == "" {
-		return gitlab.TransientError(fmt.Errorf("could not find ssh port forwarded for vm"))
-	}
-	log.Debugf("node SSH port to VM: %s\n", nodeSshPort)
-
 	gitlabScriptFile, err := os.Open(args[0])
 	if err != nil {
 		return gitlab.TransientError(fmt.Errorf("failed to open script file at %q: %w", args[0], err))
@@ -70,75 +68,84 @@ func executeRun(ctx context.Context, env gitlab.Environment, args []string) erro
 	defer gitlabScriptFile.Close()
 	log.Debugf("gitlab script path: %s", args[0])
 
-	sshUserName := env.SSHUserName
-	if sshUserName == "" {
-		sshUserName = defaultSshUserName
-	}
-
-	sshPassword := env.SSHPassword
-	if sshPassword == "" {
-		sshPassword = defaultSshPassword
-	}
-
-	sshClientConfig := &ssh.ClientConfig{
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		User:            sshUserName,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(sshPassword),
-		},
-	}
-
-	node, err := controller.GetNode(ctx, ankacloud.GetNodeRequest{Id: instance.NodeId})
+	sshClient, err := dialVM(ctx, env, backend, instance)
 	if err != nil {
-		return gitlab.TransientError(fmt.Errorf("failed to get node %s: %w", instance.NodeId, err))
-	}
-
-	addr := fmt.Sprintf("%s:%s", node.IP, nodeSshPort)
-	var sshClient *ssh.Client
-
-	// retry logic mimics what is done by the official Gitlab Runner (true for gitlab runner v16.7.0)
-	maxAttempts := env.SSHAttempts
-	if maxAttempts < 1 {
-		maxAttempts = 4
-	}
-	sshConnectionAttemptDelay := env.SSHConnectionAttemptDelay
-	if sshConnectionAttemptDelay < 1 {
-		sshConnectionAttemptDelay = 5
-	}
-	for i := 0; i < maxAttempts; i++ {
-		log.Debugf("attempt #%d to establish ssh connection to %q\n", i+1, addr)
-		sshClient, err = ssh.Dial("tcp", addr, sshClientConfig)
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Duration(sshConnectionAttemptDelay) * time.Second)
-	}
-	if err != nil {
-		return gitlab.TransientError(fmt.Errorf("failed to create new ssh client connection to %q: %w", addr, err))
+		return gitlab.TransientError(err)
 	}
 	defer sshClient.Close()
 
-	log.Debugln("ssh connection established")
+	log.SSH.Debugf("ssh connection established\n")
 
+	_, sessionSpan := tracing.Start(ctx, "ssh session", tracing.KindClient)
+	defer sessionSpan.End()
 	session, err := sshClient.NewSession()
 	if err != nil {
+		sessionSpan.SetError(err)
 		return gitlab.TransientError(fmt.Errorf("failed to start new ssh session: %w", err))
 	}
 	defer session.Close()
-	log.Debugln("ssh session opened")
+	log.SSH.Debugf("ssh session opened\n")
 
-	session.Stdin = gitlabScriptFile
+	// the variables come first, so the whole script sees them
+	session.Stdin = io.MultiReader(strings.NewReader(vmVariables(env, instance)), gitlabScriptFile)
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
 
+	_, scriptSpan := tracing.Start(ctx, "script "+args[1], tracing.KindInternal)
+	defer scriptSpan.End()
+	scriptSpan.SetAttribute("gitlab.run_stage", args[1])
+
+	runStart := time.Now()
 	err = session.Shell()
 	if err != nil {
+		scriptSpan.SetError(err)
 		return gitlab.TransientError(fmt.Errorf("failed to start Shell on SSH session: %w", err))
 	}
 
 	log.Debugln("waiting for remote execution to finish")
 	err = session.Wait()
+	metrics.Observe(metrics.RunStageSeconds, time.Since(runStart).Seconds(), "run_stage", args[1])
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		scriptSpan.SetAttribute("process.exit.code", exitErr.ExitStatus())
+	}
+	scriptSpan.SetError(err)
 
 	log.Debugln("remote execution finished")
 	return err
 }
+
+// vmVariables exports what the job runs on to the script, for test reports and crash uploads to tell
+// the infrastructure that produced them
+func vmVariables(env gitlab.Environment, instance *ankacloud.Instance) string {
+	templateId := instance.TemplateId
+	if templateId == "" {
+		templateId = env.TemplateId
+	}
+	var vmName, nodeName, nodeIP string
+	if instance.VMInfo != nil {
+		vmName = instance.VMInfo.Name
+	}
+	if instance.Node != nil {
+		nodeName = instance.Node.Name
+		nodeIP = instance.Node.IP
+	}
+
+	var b strings.Builder
+	for _, v := range []struct{ name, value string }{
+		{"ANKA_CLOUD_INSTANCE_ID", instance.Id},
+		{"ANKA_CLOUD_VM_NAME", vmName},
+		{"ANKA_CLOUD_NODE_ID", instance.NodeId},
+		{"ANKA_CLOUD_NODE_NAME", nodeName},
+		{"ANKA_CLOUD_NODE_IP", nodeIP},
+		{"ANKA_CLOUD_TEMPLATE_ID", templateId},
+		// not the requested tag, which is empty when the job wants the latest one
+		{"ANKA_CLOUD_RESOLVED_TAG", instance.Tag},
+	} {
+		if v.value == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "export %s='%s'\n", v.name, strings.ReplaceAll(v.value, "'", `'\''`))
+	}
+	return b.String()
+}
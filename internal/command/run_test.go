@@ -0,0 +1,57 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+)
+
+func TestVMVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      gitlab.Environment
+		instance ankacloud.Instance
+		expected string
+	}{
+		{
+			name: "controller instance",
+			instance: ankacloud.Instance{
+				Id:         "instance-1",
+				VMInfo:     &ankacloud.VM{Name: "vm-1"},
+				NodeId:     "node-1",
+				Node:       &ankacloud.Node{Name: "mac-mini-1", IP: "10.0.0.1"},
+				TemplateId: "template-1",
+				Tag:        "v2",
+			},
+			expected: "export ANKA_CLOUD_INSTANCE_ID='instance-1'\n" +
+				"export ANKA_CLOUD_VM_NAME='vm-1'\n" +
+				"export ANKA_CLOUD_NODE_ID='node-1'\n" +
+				"export ANKA_CLOUD_NODE_NAME='mac-mini-1'\n" +
+				"export ANKA_CLOUD_NODE_IP='10.0.0.1'\n" +
+				"export ANKA_CLOUD_TEMPLATE_ID='template-1'\n" +
+				"export ANKA_CLOUD_RESOLVED_TAG='v2'\n",
+		},
+		{
+			name:     "template of the job and no tag reported",
+			env:      gitlab.Environment{TemplateId: "template-2", TemplateTag: "requested"},
+			instance: ankacloud.Instance{Id: "instance-2"},
+			expected: "export ANKA_CLOUD_INSTANCE_ID='instance-2'\n" +
+				"export ANKA_CLOUD_TEMPLATE_ID='template-2'\n",
+		},
+		{
+			name:     "single quotes",
+			instance: ankacloud.Instance{Id: "instance-3", VMInfo: &ankacloud.VM{Name: "it's a 'vm'"}},
+			expected: "export ANKA_CLOUD_INSTANCE_ID='instance-3'\n" +
+				`export ANKA_CLOUD_VM_NAME='it'\''s a '\''vm'\'''` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := vmVariables(test.env, &test.instance); got != test.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.expected, got)
+			}
+		})
+	}
+}
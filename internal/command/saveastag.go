@@ -0,0 +1,75 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+// saveAsTag saves the VM of a successful "bake" job and pushes it to the registry as a new tag
+// of its template, waiting for the push to finish.
+func saveAsTag(ctx context.Context, env gitlab.Environment, controller *ankacloud.Controller, instance *ankacloud.Instance) error {
+	saveAsTag := env.SaveAsTag
+	ctx, cancel := context.WithTimeout(ctx, saveAsTag.Timeout)
+	defer cancel()
+
+	templateId := instance.TemplateId
+	if templateId == "" {
+		templateId = env.TemplateId
+	}
+	if templateId == "" && env.TemplateName != "" {
+		var err error
+		templateId, err = controller.GetTemplateIdByName(ctx, env.TemplateName)
+		if err != nil {
+			return fmt.Errorf("failed to get template id of template named %q: %w", env.TemplateName, err)
+		}
+	}
+	if templateId == "" {
+		return fmt.Errorf("could not tell the template of instance %s", instance.Id)
+	}
+
+	template, err := controller.GetTemplate(ctx, templateId)
+	if err != nil {
+		return err
+	}
+	tagExists := slices.ContainsFunc(template.Versions, func(v ankacloud.TemplateVersion) bool {
+		return v.Tag == saveAsTag.Tag
+	})
+	if tagExists {
+		if !saveAsTag.Overwrite {
+			return fmt.Errorf("tag %q already exists on template %q, set ANKA_CLOUD_SAVE_AS_TAG_OVERWRITE to replace it", saveAsTag.Tag, templateId)
+		}
+		// the controller replaces the tag as part of the push, so a failed save leaves the existing one in place
+		log.Colorf("tag %q already exists on template %q and will be replaced once the VM is pushed\n", saveAsTag.Tag, templateId)
+	}
+
+	log.Colorf("saving VM of instance %s as tag %q of template %q -- please be patient...\n", instance.Id, saveAsTag.Tag, templateId)
+	requestId, err := controller.SaveImage(ctx, ankacloud.SaveImageRequest{
+		InstanceId:  instance.Id,
+		TemplateId:  templateId,
+		Tag:         saveAsTag.Tag,
+		Description: saveAsTag.Description,
+		// reverts the existing tag in the registry before pushing the new one in its place
+		RevertBeforePush: tagExists,
+	})
+	if err != nil {
+		return err
+	}
+	log.Debugf("save image request id: %s\n", requestId)
+
+	request, err := controller.WaitForSaveImage(ctx, requestId)
+	if err != nil {
+		return fmt.Errorf("failed to wait for save image request %s: %w", requestId, err)
+	}
+
+	tag := request.Tag
+	if tag == "" {
+		tag = saveAsTag.Tag
+	}
+	log.Colorf("VM saved and pushed as tag %q of template %q (%s)\n", tag, template.Name, templateId)
+	return nil
+}
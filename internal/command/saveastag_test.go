@@ -0,0 +1,66 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+)
+
+func TestSaveAsTagExistingTag(t *testing.T) {
+	tests := []struct {
+		name      string
+		tag       string
+		overwrite bool
+		wantErr   string
+		saved     bool
+		revert    bool
+	}{
+		{name: "new tag", tag: "baked", saved: true},
+		{name: "existing tag", tag: "v1", wantErr: "already exists"},
+		{name: "overwritten tag", tag: "v1", overwrite: true, saved: true, revert: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved *ankacloud.SaveImageRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/api/v1/registry/vm":
+					w.Write([]byte(`{"status": "OK", "body": {"id": "template-id", "name": "template", "versions": [{"number": 1, "tag": "v1"}]}}`))
+				case r.Method == http.MethodPost && r.URL.Path == "/api/v1/image":
+					saved = &ankacloud.SaveImageRequest{}
+					if err := json.NewDecoder(r.Body).Decode(saved); err != nil {
+						t.Error(err)
+					}
+					w.Write([]byte(`{"status": "OK", "body": "request-id"}`))
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			controller := ankacloud.NewController(&ankacloud.APIClient{ControllerURL: server.URL, HttpClient: server.Client()})
+			env := gitlab.Environment{SaveAsTag: gitlab.SaveAsTag{Tag: tt.tag, Overwrite: tt.overwrite, Timeout: 100 * time.Millisecond}}
+			// waiting for the push times out, what matters is what was asked of the controller
+			err := saveAsTag(context.Background(), env, controller, &ankacloud.Instance{Id: "instance-id", TemplateId: "template-id"})
+
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+			if tt.saved != (saved != nil) {
+				t.Fatalf("expected saved %v, got %+v", tt.saved, saved)
+			}
+			if saved != nil && (saved.Tag != tt.tag || saved.TemplateId != "template-id" || saved.RevertBeforePush != tt.revert) {
+				t.Errorf("unexpected save image request %+v", saved)
+			}
+		})
+	}
+}
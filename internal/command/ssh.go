@@ -0,0 +1,152 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/audit"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/metrics"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/proxy"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/tracing"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSshUserName = "anka"
+	defaultSshPassword = "admin"
+)
+
+// dialVM opens an SSH connection to the instance's VM through the node's forwarded port,
+// or through the backend for backends that reach VMs themselves.
+func dialVM(ctx context.Context, env gitlab.Environment, backend Backend, instance *ankacloud.Instance) (sshClient *ssh.Client, err error) {
+	ctx, span := tracing.Start(ctx, "ssh dial", tracing.KindClient)
+	span.SetAttribute("anka.instance.id", instance.Id)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	sshUserName := env.SSHUserName
+	if sshUserName == "" {
+		sshUserName = defaultSshUserName
+	}
+
+	sshPassword := env.SSHPassword
+	if sshPassword == "" {
+		sshPassword = defaultSshPassword
+	}
+
+	sshClientConfig := &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:            sshUserName,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(sshPassword),
+		},
+	}
+
+	var addr string
+	var dial func() (*ssh.Client, error)
+	if dialer, ok := backend.(vmDialer); ok {
+		addr = instance.Id
+		dial = func() (*ssh.Client, error) {
+			conn, vmAddr, err := dialer.DialVM(ctx, instance)
+			if err != nil {
+				return nil, err
+			}
+			sshConn, chans, reqs, err := ssh.NewClientConn(conn, vmAddr, sshClientConfig)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return ssh.NewClient(sshConn, chans, reqs), nil
+		}
+	} else {
+		nodeSshPort, err := getNodeSSHPort(instance)
+		if err != nil {
+			return nil, err
+		}
+		log.SSH.Debugf("node SSH port to VM: %d\n", nodeSshPort)
+
+		node, err := backend.GetNode(ctx, ankacloud.GetNodeRequest{Id: instance.NodeId})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get node %s: %w", instance.NodeId, err)
+		}
+		if instance.Node == nil {
+			instance.Node = node
+		}
+
+		addr = fmt.Sprintf("%s:%d", node.IP, nodeSshPort)
+		dial = func() (*ssh.Client, error) {
+			return ssh.Dial("tcp", addr, sshClientConfig)
+		}
+
+		if env.SSHViaProxy {
+			proxyConfig, err := proxy.New(env.ProxyURL, proxy.ParseNoProxy(env.NoProxy))
+			if err != nil {
+				return nil, err
+			}
+			log.SSH.Debugf("dialing ssh through proxy %s\n", proxyConfig)
+			dial = func() (*ssh.Client, error) {
+				conn, err := proxyConfig.DialContext(ctx, "tcp", addr)
+				if err != nil {
+					return nil, err
+				}
+				sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshClientConfig)
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return ssh.NewClient(sshConn, chans, reqs), nil
+			}
+		}
+	}
+
+	// retry logic mimics what is done by the official Gitlab Runner (true for gitlab runner v16.7.0)
+	maxAttempts := env.SSHAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 4
+	}
+	sshConnectionAttemptDelay := env.SSHConnectionAttemptDelay
+	if sshConnectionAttemptDelay < 1 {
+		sshConnectionAttemptDelay = 5
+	}
+	dialStart := time.Now()
+	attempts := 0
+	// the section only shows up when the VM is not ready yet, so connecting to a ready VM stays quiet
+	var section *log.Section
+	defer func() { section.End("VM of instance %s is not accepting SSH connections", instance.Id) }()
+	for attempts < maxAttempts {
+		attempts++
+		log.SSH.Debugf("attempt #%d to establish ssh connection to %q\n", attempts, addr)
+		sshClient, err = dial()
+		if err == nil {
+			break
+		}
+		if section == nil {
+			section = log.StartSection("ssh", "Waiting for the VM of instance %s to accept SSH connections", instance.Id)
+		}
+		log.SSH.Colorf("attempt #%d to connect to %s failed: %s\n", attempts, addr, err)
+		time.Sleep(time.Duration(sshConnectionAttemptDelay) * time.Second)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new ssh client connection to %q: %w", addr, err)
+	}
+	section.End("SSH connection to %s established after %d attempts", addr, attempts)
+	span.SetAttribute("server.address", addr)
+	span.SetAttribute("ssh.attempts", attempts)
+	metrics.Observe(metrics.SSHConnectAttempts, float64(attempts))
+	metrics.Observe(metrics.SSHConnectSeconds, time.Since(dialStart).Seconds())
+	audit.Record(audit.Event{
+		Action:     audit.ActionSSHConnected,
+		InstanceId: instance.Id,
+		NodeId:     instance.NodeId,
+		Duration:   time.Since(dialStart).Milliseconds(),
+		Message:    fmt.Sprintf("%s after %d attempt(s)", addr, attempts),
+	})
+
+	return sshClient, nil
+}
@@ -1,10 +1,17 @@
 package command
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
 	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/proxy"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
 )
 
 func getAPIClientConfig(env gitlab.Environment) ankacloud.APIClientConfig {
@@ -16,6 +23,40 @@ func getAPIClientConfig(env gitlab.Environment) ankacloud.APIClientConfig {
 		apiClientConfig.CustomHttpHeaders = env.CustomHttpHeaders
 	}
 
+	if env.UAKCredentialsPath != "" {
+		apiClientConfig.UAKCredentialsPath = env.UAKCredentialsPath
+	}
+
+	if env.OAuth.Enabled() {
+		apiClientConfig.OAuth = ankacloud.OAuthConfig{
+			TokenURL:         env.OAuth.TokenURL,
+			ClientId:         env.OAuth.ClientId,
+			ClientSecretPath: env.OAuth.ClientSecretPath,
+			Scopes:           env.OAuth.Scopes,
+			IdToken:          env.OAuth.IdToken,
+		}
+	}
+
+	apiClientConfig.Retry = ankacloud.DefaultRetryConfig()
+	if env.Retry.Attempts > 0 {
+		apiClientConfig.Retry.MaxAttempts = env.Retry.Attempts
+	}
+	if env.Retry.InitialDelay > 0 {
+		apiClientConfig.Retry.InitialDelay = env.Retry.InitialDelay
+	}
+	if env.Retry.MaxDelay > 0 {
+		apiClientConfig.Retry.MaxDelay = env.Retry.MaxDelay
+	}
+
+	if env.ProxyURL != "" {
+		apiClientConfig.ProxyURL = env.ProxyURL
+		apiClientConfig.NoProxy = proxy.ParseNoProxy(env.NoProxy)
+	}
+
+	if env.StateDir != "" {
+		apiClientConfig.TokenCacheDir = filepath.Join(env.StateDir, "tokens")
+	}
+
 	if strings.HasPrefix(env.ControllerURL, "https") {
 		apiClientConfig.IsTLS = true
 
@@ -35,7 +76,110 @@ func getAPIClientConfig(env gitlab.Environment) ankacloud.APIClientConfig {
 			apiClientConfig.ClientCertKeyPath = env.ClientCertKeyPath
 		}
 
+		apiClientConfig.CaCertPEM = env.CaCertPEM
+		apiClientConfig.ClientCertPEM = env.ClientCertPEM
+		apiClientConfig.ClientCertKeyPEM = env.ClientCertKeyPEM
+		apiClientConfig.ClientCertP12Path = env.ClientCertP12Path
+		apiClientConfig.ClientCertPassphrasePath = env.ClientCertPassphrasePath
+		apiClientConfig.TLSMinVersion = env.TLSMinVersion
+		apiClientConfig.TLSCipherSuites = env.TLSCipherSuites
+		apiClientConfig.TLSPins = env.TLSPins
+		apiClientConfig.CertExpiryWarning = env.CertExpiryWarning
+
 	}
 
 	return apiClientConfig
 }
+
+// instances created by the executor carry this metadata, for reap to tell them apart from the instances of
+// other tools using job URLs as external ids
+const (
+	createdByKey   = "created_by"
+	createdByValue = "anka-cloud-gitlab-executor"
+)
+
+func createdByExecutor(instance ankacloud.Instance) bool {
+	return instance.Metadata[createdByKey] == createdByValue
+}
+
+// getStateStore returns the runner host job journal, or nil if it is not configured.
+// Stages work without the journal, only slower, so a state dir that can't be opened is just warned about.
+func getStateStore(env gitlab.Environment) *state.Store {
+	if env.StateDir == "" {
+		return nil
+	}
+
+	store, err := state.NewStore(env.StateDir)
+	if err != nil {
+		log.Warnf("failed to open state dir: %s\n", err)
+		return nil
+	}
+	return store
+}
+
+// getJobInstance returns the job's instance. The instance id recorded in the state journal at prepare
+// is looked up directly, which is much cheaper than searching all the controller's instances by external id,
+// what every run stage does without a state dir.
+func getJobInstance(ctx context.Context, backend Backend, store *state.Store, jobURL string) (*ankacloud.Instance, error) {
+	if store == nil {
+		log.Debugf("ANKA_CLOUD_STATE_DIR is not set, searching all instances for the one of job %s\n", jobURL)
+	} else {
+		job, ok, err := store.Load(jobURL)
+		if err != nil {
+			log.Debugf("failed to read job state: %s\n", err)
+		}
+		if ok && job.InstanceId != "" {
+			start := time.Now()
+			instance, err := backend.GetInstance(ctx, ankacloud.GetInstanceRequest{Id: job.InstanceId})
+			switch {
+			case err != nil:
+				log.Debugf("failed to get recorded instance %s, searching by external id: %s\n", job.InstanceId, err)
+			case instance.ExternalId != "" && instance.ExternalId != jobURL:
+				log.Debugf("recorded instance %s belongs to %s, searching by external id\n", job.InstanceId, instance.ExternalId)
+			case ankacloud.SelectUsableInstance([]*ankacloud.Instance{instance}) == nil:
+				log.Debugf("recorded instance %s is %s, searching by external id\n", job.InstanceId, instance.State)
+			default:
+				log.Debugf("got recorded instance %s in %s\n", job.InstanceId, time.Since(start))
+				if instance.Id == "" {
+					instance.Id = job.InstanceId
+				}
+				return instance, nil
+			}
+		}
+	}
+
+	return backend.GetInstanceByExternalId(ctx, jobURL)
+}
+
+// fillTemplateId sets the template of instances whose backend can't tell it (VMs cloned on a node) to the
+// one prepare recorded in the journal
+func fillTemplateId(store *state.Store, jobURL string, instances ...*ankacloud.Instance) {
+	if store == nil {
+		return
+	}
+	job, ok, err := store.Load(jobURL)
+	if err != nil {
+		log.Debugf("failed to read job state: %s\n", err)
+	}
+	if !ok || job.TemplateId == "" {
+		return
+	}
+	for _, instance := range instances {
+		if instance.TemplateId == "" {
+			instance.TemplateId = job.TemplateId
+		}
+	}
+}
+
+func getNodeSSHPort(instance *ankacloud.Instance) (int, error) {
+	if instance.VMInfo == nil {
+		return 0, fmt.Errorf("instance has no VM: %+v", instance)
+	}
+
+	for _, rule := range instance.VMInfo.PortForwardingRules {
+		if rule.VmPort == 22 && rule.Protocol == "tcp" {
+			return rule.NodePort, nil
+		}
+	}
+	return 0, fmt.Errorf("could not find ssh port forwarded for vm")
+}
@@ -0,0 +1,37 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/state"
+)
+
+func TestFillTemplateId(t *testing.T) {
+	const jobURL = "https://gitlab.example.com/group/project/-/jobs/1"
+	store, err := state.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(state.Job{JobURL: jobURL, TemplateId: "template-id"}); err != nil {
+		t.Fatal(err)
+	}
+
+	clone := &ankacloud.Instance{Id: "anka-gle-1"}
+	known := &ankacloud.Instance{Id: "instance-id", TemplateId: "other-template-id"}
+	fillTemplateId(store, jobURL, clone, known)
+
+	if clone.TemplateId != "template-id" {
+		t.Errorf("expected recorded template id, got %q", clone.TemplateId)
+	}
+	if known.TemplateId != "other-template-id" {
+		t.Errorf("expected template id reported by the backend to be kept, got %q", known.TemplateId)
+	}
+
+	other := &ankacloud.Instance{Id: "anka-gle-2"}
+	fillTemplateId(store, "https://gitlab.example.com/group/project/-/jobs/2", other)
+	fillTemplateId(nil, jobURL, other)
+	if other.TemplateId != "" {
+		t.Errorf("expected no template id, got %q", other.TemplateId)
+	}
+}
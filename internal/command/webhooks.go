@@ -0,0 +1,37 @@
+package command
+
+import (
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/ankacloud"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/gitlab"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/webhook"
+)
+
+// webhookInstance describes the instance in webhook payloads, falling back on the job configuration
+// for what the instance does not tell (or when there is no instance yet)
+func webhookInstance(env gitlab.Environment, instance *ankacloud.Instance) webhook.Instance {
+	details := webhook.Instance{
+		TemplateId: env.TemplateId,
+		Tag:        env.TemplateTag,
+		Controller: env.ControllerURL,
+	}
+	if instance == nil {
+		return details
+	}
+
+	details.Id = instance.Id
+	details.NodeId = instance.NodeId
+	if instance.TemplateId != "" {
+		details.TemplateId = instance.TemplateId
+	}
+	if instance.Tag != "" {
+		details.Tag = instance.Tag
+	}
+	if instance.VMInfo != nil {
+		details.VMName = instance.VMInfo.Name
+	}
+	if instance.Node != nil {
+		details.NodeName = instance.Node.Name
+		details.NodeIP = instance.Node.IP
+	}
+	return details
+}
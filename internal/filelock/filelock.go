@@ -0,0 +1,40 @@
+// Package filelock serializes the executor processes of a runner host around shared files, like the
+// state dir or the metrics totals. Jobs run concurrently, each stage in its own process.
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// a lock older than this was left by a crashed process
+	staleAfter  = 10 * time.Second
+	giveUpAfter = 5 * time.Second
+)
+
+// Lock creates the lock file, waiting for other processes to remove theirs first. It returns the
+// function removing it.
+func Lock(path string) (func(), error) {
+	deadline := time.Now().Add(giveUpAfter)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleAfter {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %s", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,138 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const defaultAPIRequestTimeout = 10 * time.Second
+
+var jobURLPattern = regexp.MustCompile(`^(https?://[^/]+)/(.+)/-/jobs/(\d+)$`)
+
+// JobRef identifies a job by the parts of its web URL, which is what the executor uses as the instance external id.
+type JobRef struct {
+	BaseURL     string
+	ProjectPath string
+	JobId       string
+}
+
+// ParseJobURL splits a job web URL such as https://gitlab.com/group/project/-/jobs/123.
+// If baseURL is set, it is used to tell apart a relative URL root from the project path.
+func ParseJobURL(jobURL string, baseURL string) (JobRef, error) {
+	matches := jobURLPattern.FindStringSubmatch(jobURL)
+	if matches == nil {
+		return JobRef{}, fmt.Errorf("%q is not a gitlab job url", jobURL)
+	}
+
+	ref := JobRef{
+		BaseURL:     matches[1],
+		ProjectPath: matches[2],
+		JobId:       matches[3],
+	}
+
+	if baseURL != "" {
+		baseURL = strings.TrimSuffix(baseURL, "/")
+		if !strings.HasPrefix(jobURL, baseURL+"/") {
+			return JobRef{}, fmt.Errorf("job url %q does not belong to gitlab at %q", jobURL, baseURL)
+		}
+		ref.BaseURL = baseURL
+		ref.ProjectPath = strings.TrimSuffix(strings.TrimPrefix(jobURL, baseURL+"/"), "/-/jobs/"+ref.JobId)
+	}
+
+	return ref, nil
+}
+
+func (s jobStatus) IsFinished() bool {
+	switch s {
+	case JobStatusSuccess, JobStatusFailed, JobStatusCanceled, JobStatusSkipped:
+		return true
+	}
+	return false
+}
+
+// APIClient is a minimal client for the Gitlab REST API, authenticating with a private/project token.
+type APIClient struct {
+	BaseURL    string
+	Token      string
+	HttpClient *http.Client
+}
+
+func NewAPIClient(baseURL string, token string) *APIClient {
+	return &APIClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		HttpClient: &http.Client{Timeout: defaultAPIRequestTimeout},
+	}
+}
+
+func (c *APIClient) sameGitlab(jobURL string) error {
+	if c.BaseURL == "" {
+		return fmt.Errorf("no gitlab base url to check job url %q against", jobURL)
+	}
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return fmt.Errorf("invalid gitlab base url %q: %w", c.BaseURL, err)
+	}
+	u, err := url.Parse(jobURL)
+	if err != nil {
+		return fmt.Errorf("invalid job url %q: %w", jobURL, err)
+	}
+	if u.Scheme != base.Scheme || u.Host != base.Host || u.User != nil {
+		return fmt.Errorf("job url %q does not belong to gitlab at %q", jobURL, c.BaseURL)
+	}
+	return nil
+}
+
+type job struct {
+	Status jobStatus `json:"status"`
+}
+
+// GetJobStatus only sends the token to the Gitlab of BaseURL: job URLs of any other scheme or host are
+// refused, as they come from instance external ids, which anyone allowed on the controller may set.
+func (c *APIClient) GetJobStatus(ctx context.Context, jobURL string) (jobStatus, error) {
+	if err := c.sameGitlab(jobURL); err != nil {
+		return "", err
+	}
+	ref, err := ParseJobURL(jobURL, c.BaseURL)
+	if err != nil {
+		return "", err
+	}
+
+	endpointUrl := fmt.Sprintf("%s/api/v4/projects/%s/jobs/%s", ref.BaseURL, url.PathEscape(ref.ProjectPath), ref.JobId)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpointUrl, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create GET request to %q: %w", endpointUrl, err)
+	}
+	if c.Token != "" {
+		req.Header.Set("PRIVATE-TOKEN", c.Token)
+	}
+
+	r, err := c.HttpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send GET request to %s: %w", endpointUrl, err)
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if r.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code: %d, error: %s", r.StatusCode, string(body))
+	}
+
+	var j job
+	if err := json.Unmarshal(body, &j); err != nil {
+		return "", fmt.Errorf("failed to parse response body %q: %w", string(body), err)
+	}
+
+	return j.Status, nil
+}
@@ -0,0 +1,122 @@
+package gitlab
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseJobURL(t *testing.T) {
+	testCases := []struct {
+		jobURL              string
+		baseURL             string
+		expectedBaseURL     string
+		expectedProjectPath string
+		expectedJobId       string
+		expectedErr         bool
+	}{
+		{
+			jobURL:              "https://gitlab.com/group/project/-/jobs/123",
+			expectedBaseURL:     "https://gitlab.com",
+			expectedProjectPath: "group/project",
+			expectedJobId:       "123",
+		},
+		{
+			jobURL:              "https://gitlab.com/group/subgroup/project/-/jobs/456",
+			expectedBaseURL:     "https://gitlab.com",
+			expectedProjectPath: "group/subgroup/project",
+			expectedJobId:       "456",
+		},
+		{
+			jobURL:              "https://example.com/gitlab/group/project/-/jobs/789",
+			baseURL:             "https://example.com/gitlab/",
+			expectedBaseURL:     "https://example.com/gitlab",
+			expectedProjectPath: "group/project",
+			expectedJobId:       "789",
+		},
+		{
+			jobURL:      "https://other.com/group/project/-/jobs/789",
+			baseURL:     "https://example.com",
+			expectedErr: true,
+		},
+		{
+			jobURL:      "fake-gitlab-job-url",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		ref, err := ParseJobURL(tc.jobURL, tc.baseURL)
+		if tc.expectedErr {
+			if err == nil {
+				t.Errorf("expected error for %q, got %+v", tc.jobURL, ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.jobURL, err)
+			continue
+		}
+		if ref.BaseURL != tc.expectedBaseURL || ref.ProjectPath != tc.expectedProjectPath || ref.JobId != tc.expectedJobId {
+			t.Errorf("unexpected job ref for %q: %+v", tc.jobURL, ref)
+		}
+	}
+}
+
+func TestGetJobStatus(t *testing.T) {
+	const token = "fake-token"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/v4/projects/group%2Fproject/jobs/123" {
+			t.Errorf("unexpected path %q", r.URL.EscapedPath())
+		}
+		if r.Header.Get("PRIVATE-TOKEN") != token {
+			t.Errorf("expected token %q, got %q", token, r.Header.Get("PRIVATE-TOKEN"))
+		}
+		w.Write([]byte(`{"id": 123, "status": "canceled"}`))
+	}))
+	defer server.Close()
+
+	client := NewAPIClient(server.URL, token)
+	status, err := client.GetJobStatus(context.Background(), server.URL+"/group/project/-/jobs/123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != JobStatusCanceled {
+		t.Errorf("expected status %q, got %q", JobStatusCanceled, status)
+	}
+	if !status.IsFinished() {
+		t.Errorf("expected status %q to be finished", status)
+	}
+}
+
+func TestGetJobStatusOtherGitlab(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"id": 123, "status": "canceled"}`))
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name    string
+		baseURL string
+		jobURL  string
+	}{
+		{"no base url", "", server.URL + "/group/project/-/jobs/123"},
+		{"other host", "https://gitlab.example.com", server.URL + "/group/project/-/jobs/123"},
+		{"other scheme", strings.Replace(server.URL, "http://", "https://", 1), server.URL + "/group/project/-/jobs/123"},
+		{"user info", server.URL, strings.Replace(server.URL, "http://", "http://gitlab@", 1) + "/group/project/-/jobs/123"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewAPIClient(tc.baseURL, "fake-token").GetJobStatus(context.Background(), tc.jobURL); err == nil {
+				t.Errorf("expected job url %q to be refused for base url %q", tc.jobURL, tc.baseURL)
+			}
+		})
+	}
+	if requests != 0 {
+		t.Errorf("expected no request to be sent, got %d", requests)
+	}
+}
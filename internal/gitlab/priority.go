@@ -0,0 +1,104 @@
+package gitlab
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	MinPriority = 1
+	MaxPriority = 10000
+
+	pipelineSourceMergeRequest = "merge_request_event"
+	pipelineSourceSchedule     = "schedule"
+)
+
+// PriorityRules maps GitLab pipeline context to Anka Cloud instance priorities.
+// A zero value disables the rule.
+type PriorityRules struct {
+	ProtectedTag  int `json:"protected_tag"`
+	DefaultBranch int `json:"default_branch"`
+	MergeRequest  int `json:"merge_request"`
+	Schedule      int `json:"schedule"`
+	Default       int `json:"default"`
+}
+
+// PriorityAgeBoost lowers (makes more urgent) the priority by Step for every Interval
+// that passed since the pipeline was created, so retried jobs do not starve in the queue.
+type PriorityAgeBoost struct {
+	Interval time.Duration
+	Step     int
+}
+
+type ResolvedPriority struct {
+	Priority    int
+	Rule        string
+	AgeBoost    int
+	PipelineAge time.Duration
+}
+
+func (r ResolvedPriority) String() string {
+	if r.AgeBoost == 0 {
+		return fmt.Sprintf("priority %d (rule: %s)", r.Priority, r.Rule)
+	}
+	return fmt.Sprintf("priority %d (rule: %s, age boost: -%d after waiting %s)", r.Priority, r.Rule, r.AgeBoost, r.PipelineAge.Round(time.Second))
+}
+
+func (r PriorityRules) validate() error {
+	for name, priority := range map[string]int{
+		"protected_tag":  r.ProtectedTag,
+		"default_branch": r.DefaultBranch,
+		"merge_request":  r.MergeRequest,
+		"schedule":       r.Schedule,
+		"default":        r.Default,
+	} {
+		if priority != 0 && (priority < MinPriority || priority > MaxPriority) {
+			return fmt.Errorf("rule %q priority must be between %d and %d. Got %d", name, MinPriority, MaxPriority, priority)
+		}
+	}
+	return nil
+}
+
+// ResolvePriority computes the instance priority from the configured rules and the pipeline context.
+// Rules are evaluated in order: protected tag, default branch, merge request, schedule.
+// If no rule matches, the job's own priority variable is used, then the default rule.
+func (e Environment) ResolvePriority(now time.Time) ResolvedPriority {
+	resolved := ResolvedPriority{Priority: e.Priority, Rule: "variable"}
+
+	if e.PriorityRules != nil {
+		rules := e.PriorityRules
+		switch {
+		case rules.ProtectedTag != 0 && e.CommitTag != "" && e.CommitRefProtected:
+			resolved = ResolvedPriority{Priority: rules.ProtectedTag, Rule: "protected_tag"}
+		case rules.DefaultBranch != 0 && e.CommitBranch != "" && e.CommitBranch == e.DefaultBranch:
+			resolved = ResolvedPriority{Priority: rules.DefaultBranch, Rule: "default_branch"}
+		case rules.MergeRequest != 0 && e.PipelineSource == pipelineSourceMergeRequest:
+			resolved = ResolvedPriority{Priority: rules.MergeRequest, Rule: "merge_request"}
+		case rules.Schedule != 0 && e.PipelineSource == pipelineSourceSchedule:
+			resolved = ResolvedPriority{Priority: rules.Schedule, Rule: "schedule"}
+		case e.Priority == 0 && rules.Default != 0:
+			resolved = ResolvedPriority{Priority: rules.Default, Rule: "default"}
+		}
+	}
+
+	if resolved.Priority == 0 {
+		// the controller applies its own default priority
+		resolved.Rule = "controller default"
+		return resolved
+	}
+
+	boost := e.PriorityAgeBoost
+	if boost.Interval > 0 && boost.Step > 0 && !e.PipelineCreatedAt.IsZero() {
+		age := now.Sub(e.PipelineCreatedAt)
+		if age > 0 {
+			resolved.PipelineAge = age
+			resolved.AgeBoost = int(age/boost.Interval) * boost.Step
+			if resolved.Priority-resolved.AgeBoost < MinPriority {
+				resolved.AgeBoost = resolved.Priority - MinPriority
+			}
+			resolved.Priority -= resolved.AgeBoost
+		}
+	}
+
+	return resolved
+}
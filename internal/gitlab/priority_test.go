@@ -0,0 +1,181 @@
+package gitlab
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestResolvePriority(t *testing.T) {
+	rules := &PriorityRules{
+		ProtectedTag:  1,
+		DefaultBranch: 10,
+		MergeRequest:  500,
+		Schedule:      9000,
+		Default:       1000,
+	}
+
+	testCases := []struct {
+		name             string
+		env              Environment
+		expectedPriority int
+		expectedRule     string
+	}{
+		{
+			name:             "no rules uses job variable",
+			env:              Environment{Priority: 42},
+			expectedPriority: 42,
+			expectedRule:     "variable",
+		},
+		{
+			name:             "no rules and no variable",
+			env:              Environment{},
+			expectedPriority: 0,
+			expectedRule:     "controller default",
+		},
+		{
+			name:             "protected tag",
+			env:              Environment{PriorityRules: rules, CommitTag: "v1.0.0", CommitRefProtected: true},
+			expectedPriority: 1,
+			expectedRule:     "protected_tag",
+		},
+		{
+			name:             "unprotected tag falls through to default",
+			env:              Environment{PriorityRules: rules, CommitTag: "v1.0.0"},
+			expectedPriority: 1000,
+			expectedRule:     "default",
+		},
+		{
+			name:             "default branch",
+			env:              Environment{PriorityRules: rules, CommitBranch: "main", DefaultBranch: "main", PipelineSource: "push"},
+			expectedPriority: 10,
+			expectedRule:     "default_branch",
+		},
+		{
+			name:             "merge request",
+			env:              Environment{PriorityRules: rules, PipelineSource: "merge_request_event"},
+			expectedPriority: 500,
+			expectedRule:     "merge_request",
+		},
+		{
+			name:             "schedule",
+			env:              Environment{PriorityRules: rules, CommitBranch: "nightly", DefaultBranch: "main", PipelineSource: "schedule"},
+			expectedPriority: 9000,
+			expectedRule:     "schedule",
+		},
+		{
+			name:             "job variable takes precedence over default rule",
+			env:              Environment{PriorityRules: rules, Priority: 300, PipelineSource: "push"},
+			expectedPriority: 300,
+			expectedRule:     "variable",
+		},
+		{
+			name:             "disabled rule is skipped",
+			env:              Environment{PriorityRules: &PriorityRules{Default: 700}, PipelineSource: "merge_request_event"},
+			expectedPriority: 700,
+			expectedRule:     "default",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resolved := tc.env.ResolvePriority(time.Now())
+			if resolved.Priority != tc.expectedPriority {
+				t.Errorf("expected priority %d, got %d", tc.expectedPriority, resolved.Priority)
+			}
+			if resolved.Rule != tc.expectedRule {
+				t.Errorf("expected rule %q, got %q", tc.expectedRule, resolved.Rule)
+			}
+		})
+	}
+}
+
+func TestResolvePriorityAgeBoost(t *testing.T) {
+	now := time.Now()
+	env := Environment{
+		PriorityRules:     &PriorityRules{MergeRequest: 500},
+		PipelineSource:    "merge_request_event",
+		PriorityAgeBoost:  PriorityAgeBoost{Interval: 10 * time.Minute, Step: 100},
+		PipelineCreatedAt: now.Add(-35 * time.Minute),
+	}
+
+	resolved := env.ResolvePriority(now)
+	if resolved.Priority != 200 {
+		t.Errorf("expected priority 200, got %d", resolved.Priority)
+	}
+	if resolved.AgeBoost != 300 {
+		t.Errorf("expected age boost 300, got %d", resolved.AgeBoost)
+	}
+
+	env.PipelineCreatedAt = now.Add(-10 * time.Hour)
+	resolved = env.ResolvePriority(now)
+	if resolved.Priority != MinPriority {
+		t.Errorf("expected priority to be capped at %d, got %d", MinPriority, resolved.Priority)
+	}
+}
+
+func TestPriorityRulesEnvVar(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-url")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	os.Setenv(varPriorityRules, "{\"protected_tag\": 1, \"merge_request\": 500}")
+	os.Setenv(varPipelineCreatedAt, "2024-01-02T03:04:05Z")
+	os.Setenv(varCommitRefProtected, "true")
+	defer os.Clearenv()
+
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.PriorityRules == nil || env.PriorityRules.ProtectedTag != 1 || env.PriorityRules.MergeRequest != 500 {
+		t.Errorf("unexpected priority rules %+v", env.PriorityRules)
+	}
+	if !env.CommitRefProtected {
+		t.Errorf("expected commit ref to be protected")
+	}
+	if env.PipelineCreatedAt.IsZero() {
+		t.Errorf("expected pipeline created at to be parsed")
+	}
+}
+
+func TestInvalidPriorityRules(t *testing.T) {
+	defer os.Clearenv()
+
+	for _, rules := range []string{"not-json", "{\"schedule\": 20000}", "{\"default\": -1}"} {
+		os.Clearenv()
+		os.Setenv(varControllerURL, "http://fake-controller-url")
+		os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+		os.Setenv(varPriorityRules, rules)
+
+		_, err := InitEnv()
+		if !errors.Is(err, ErrInvalidVar) {
+			t.Errorf("expected error %q for rules %q, got %v", ErrInvalidVar, rules, err)
+		}
+	}
+}
+
+func TestPriorityPolicyFromRunnerEnvironment(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-url")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	os.Setenv(ankaVar("PRIORITY_RULES"), "{\"default\": 1}")
+	os.Setenv(ankaVar("PRIORITY_AGE_BOOST_INTERVAL"), "1s")
+	defer os.Clearenv()
+
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.PriorityRules != nil || env.PriorityAgeBoost.Interval != 0 {
+		t.Errorf("expected job variables to be ignored, got rules %+v and age boost %+v", env.PriorityRules, env.PriorityAgeBoost)
+	}
+
+	os.Setenv(varPriorityAgeBoostInterval, "10m")
+	if env, err = InitEnv(); err != nil || env.PriorityAgeBoost.Interval != 10*time.Minute {
+		t.Errorf("expected age boost interval of 10m, got %s, %v", env.PriorityAgeBoost.Interval, err)
+	}
+
+	os.Setenv(varPriorityAgeBoostInterval, "600")
+	if _, err := InitEnv(); !errors.Is(err, ErrInvalidVar) {
+		t.Errorf("expected a duration without unit to be rejected, got %v", err)
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
 )
 
 const (
@@ -20,6 +24,9 @@ var (
 	// Custom Executor vars
 	varDebug                     = ankaVar("DEBUG")
 	varQuietLogging              = ankaVar("QUIETER_LOGGING")
+	varLogLevel                  = ankaVar("LOG_LEVEL")
+	varLogComponentLevels        = ankaVar("LOG_COMPONENT_LEVELS")
+	varLogColor                  = ankaVar("LOG_COLOR")
 	varControllerURL             = ankaVar("CONTROLLER_URL")
 	varTemplateId                = ankaVar("TEMPLATE_ID")
 	varTemplateTag               = ankaVar("TEMPLATE_TAG")
@@ -30,6 +37,27 @@ var (
 	varSkipTLSVerify             = ankaVar("SKIP_TLS_VERIFY")
 	varClientCertPath            = ankaVar("CLIENT_CERT_PATH")
 	varClientCertKeyPath         = ankaVar("CLIENT_CERT_KEY_PATH")
+	varCaCertPEM                 = ankaVar("CA_CERT_PEM")
+	varClientCertPEM             = ankaVar("CLIENT_CERT_PEM")
+	varClientCertKeyPEM          = ankaVar("CLIENT_CERT_KEY_PEM")
+	varClientCertP12Path         = ankaVar("CLIENT_CERT_P12_PATH")
+	varClientCertPassphrasePath  = ankaVar("CLIENT_CERT_PASSPHRASE_PATH")
+	varTLSMinVersion             = ankaVar("TLS_MIN_VERSION")
+	varTLSCipherSuites           = ankaVar("TLS_CIPHER_SUITES")
+	varTLSPins                   = ankaVar("TLS_PINS")
+	varCertExpiryWarningDays     = ankaVar("CERT_EXPIRY_WARNING_DAYS")
+	varAuditLogPath              = runnerVar("AUDIT_LOG_PATH")
+	varAuditLogMaxSizeMb         = runnerVar("AUDIT_LOG_MAX_SIZE_MB")
+	varAuditLogMaxFiles          = runnerVar("AUDIT_LOG_MAX_FILES")
+	varMetricsTextfileDir        = ankaVar("METRICS_TEXTFILE_DIR")
+	varMetricsPushURL            = ankaVar("METRICS_PUSH_URL")
+	varTraceOTLPEndpoint         = ankaVar("TRACE_OTLP_ENDPOINT")
+	varTraceOTLPHeaders          = ankaVar("TRACE_OTLP_HEADERS")
+	varTraceFile                 = ankaVar("TRACE_FILE")
+	varWebhookURLs               = ankaVar("WEBHOOK_URLS")
+	varWebhookSecretPath         = ankaVar("WEBHOOK_SECRET_PATH")
+	varWebhookTimeout            = ankaVar("WEBHOOK_TIMEOUT")
+	varWebhookAttempts           = ankaVar("WEBHOOK_ATTEMPTS")
 	varSshUserName               = ankaVar("SSH_USER_NAME")
 	varSshPassword               = ankaVar("SSH_PASSWORD")
 	varSshAttempts               = ankaVar("SSH_CONNECTION_ATTEMPTS")
@@ -41,16 +69,62 @@ var (
 	varCacheDir                  = ankaVar("CACHE_DIR")
 	varVmVramMb                  = ankaVar("VM_VRAM_MB")
 	varVmVcpu                    = ankaVar("VM_VCPU")
+	varPriorityRules             = runnerVar("PRIORITY_RULES")
+	varPriorityAgeBoostInterval  = runnerVar("PRIORITY_AGE_BOOST_INTERVAL")
+	varPriorityAgeBoostStep      = runnerVar("PRIORITY_AGE_BOOST_STEP")
+	varStateDir                  = ankaVar("STATE_DIR")
+	varKeepAliveDuration         = ankaVar("KEEP_ALIVE_DURATION")
+	varKeepAliveMaxPerProject    = ankaVar("KEEP_ALIVE_MAX_PER_PROJECT")
+	varTerminateTimeout          = ankaVar("TERMINATE_TIMEOUT")
+	varDiagnosticsPaths          = ankaVar("DIAGNOSTICS_PATHS")
+	varDiagnosticsCommands       = ankaVar("DIAGNOSTICS_COMMANDS")
+	varDiagnosticsDir            = runnerVar("DIAGNOSTICS_DIR")
+	varDiagnosticsS3URL          = runnerVar("DIAGNOSTICS_S3_URL")
+	varDiagnosticsS3Credentials  = runnerVar("DIAGNOSTICS_S3_CREDENTIALS_PATH")
+	varDiagnosticsTimeout        = ankaVar("DIAGNOSTICS_TIMEOUT")
+	varSaveAsTag                 = ankaVar("SAVE_AS_TAG")
+	varSaveAsTagDescription      = ankaVar("SAVE_AS_TAG_DESCRIPTION")
+	varSaveAsTagOverwrite        = ankaVar("SAVE_AS_TAG_OVERWRITE")
+	varSaveAsTagTimeout          = ankaVar("SAVE_AS_TAG_TIMEOUT")
+	varUAKCredentialsPath        = runnerVar("UAK_CREDENTIALS_PATH")
+	varOAuthTokenURL             = runnerVar("OAUTH_TOKEN_URL")
+	varOAuthClientId             = runnerVar("OAUTH_CLIENT_ID")
+	varOAuthClientSecretPath     = runnerVar("OAUTH_CLIENT_SECRET_PATH")
+	varOAuthScopes               = ankaVar("OAUTH_SCOPES")
+	varOAuthIdTokenVar           = ankaVar("OAUTH_ID_TOKEN_VAR")
+	varProxyURL                  = ankaVar("PROXY_URL")
+	varNoProxy                   = ankaVar("NO_PROXY")
+	varSshViaProxy               = ankaVar("SSH_VIA_PROXY")
+	varRetryAttempts             = ankaVar("RETRY_ATTEMPTS")
+	varRetryInitialDelay         = ankaVar("RETRY_INITIAL_DELAY")
+	varRetryMaxDelay             = ankaVar("RETRY_MAX_DELAY")
+	varBackend                   = ankaVar("BACKEND")
+	varNodeHost                  = ankaVar("NODE_HOST")
+	varNodeSshUserName           = ankaVar("NODE_SSH_USER_NAME")
+	varNodeSshPassword           = ankaVar("NODE_SSH_PASSWORD")
+	varNodeSshKeyPath            = ankaVar("NODE_SSH_KEY_PATH")
+	varNodeSshHostKey            = ankaVar("NODE_SSH_HOST_KEY")
+	varNodeAnkaPath              = ankaVar("NODE_ANKA_PATH")
 
 	// Gitlab vars
-	varGitlabJobUrl    = gitlabVar("CI_JOB_URL")
-	varGitlabJobStatus = gitlabVar("CI_JOB_STATUS")
+	varGitlabJobUrl       = gitlabVar("CI_JOB_URL")
+	varGitlabJobStatus    = gitlabVar("CI_JOB_STATUS")
+	varProjectId          = gitlabVar("CI_PROJECT_ID")
+	varCommitTag          = gitlabVar("CI_COMMIT_TAG")
+	varCommitBranch       = gitlabVar("CI_COMMIT_BRANCH")
+	varCommitRefProtected = gitlabVar("CI_COMMIT_REF_PROTECTED")
+	varDefaultBranch      = gitlabVar("CI_DEFAULT_BRANCH")
+	varPipelineSource     = gitlabVar("CI_PIPELINE_SOURCE")
+	varPipelineCreatedAt  = gitlabVar("CI_PIPELINE_CREATED_AT")
+	varPipelineId         = gitlabVar("CI_PIPELINE_ID")
 )
 
 type Environment struct {
 	ControllerURL             string
-	Debug                     bool
-	QuietLogging              bool
+	ControllerURLs            []string
+	LogLevel                  log.Level
+	LogComponentLevels        map[log.Component]log.Level
+	LogColor                  bool
 	TemplateId                string
 	TemplateTag               string
 	NodeId                    string
@@ -60,6 +134,20 @@ type Environment struct {
 	SkipTLSVerify             bool
 	ClientCertPath            string
 	ClientCertKeyPath         string
+	CaCertPEM                 string
+	ClientCertPEM             string
+	ClientCertKeyPEM          string
+	ClientCertP12Path         string
+	ClientCertPassphrasePath  string
+	TLSMinVersion             string
+	TLSCipherSuites           []string
+	TLSPins                   []string
+	CertExpiryWarning         time.Duration
+	PipelineId                string
+	AuditLog                  AuditLog
+	Metrics                   Metrics
+	Tracing                   Tracing
+	Webhooks                  Webhooks
 	SSHUserName               string
 	SSHPassword               string
 	SSHAttempts               int
@@ -73,8 +161,127 @@ type Environment struct {
 	CacheDir                  string
 	VmVramMb                  int
 	VmVcpu                    int
+	PriorityRules             *PriorityRules
+	PriorityAgeBoost          PriorityAgeBoost
+	CommitTag                 string
+	CommitBranch              string
+	CommitRefProtected        bool
+	DefaultBranch             string
+	PipelineSource            string
+	PipelineCreatedAt         time.Time
+	StateDir                  string
+	ProjectId                 string
+	KeepAliveDuration         time.Duration
+	KeepAliveMaxPerProject    int
+	TerminateTimeout          time.Duration
+	Diagnostics               Diagnostics
+	SaveAsTag                 SaveAsTag
+	UAKCredentialsPath        string
+	OAuth                     OAuth
+	ProxyURL                  string
+	NoProxy                   string
+	SSHViaProxy               bool
+	Retry                     Retry
+	Backend                   string
+	Node                      Node
 }
 
+const (
+	// BackendController runs VMs through an Anka Build Cloud controller
+	BackendController = "controller"
+	// BackendNode runs VMs on a single Anka node without a controller, driving the anka CLI over SSH
+	BackendNode = "node"
+)
+
+// Node describes the Anka node used by the node backend
+type Node struct {
+	Host     string
+	User     string
+	Password string
+	KeyPath  string
+	HostKey  string
+	AnkaPath string
+}
+
+// AuditLog is the runner host file lifecycle events are appended to as JSON
+type AuditLog struct {
+	Path      string
+	MaxSizeMb int
+	MaxFiles  int
+}
+
+// Metrics are where the Prometheus metrics of the stages go
+type Metrics struct {
+	TextfileDir string
+	PushURL     string
+}
+
+// Tracing is where the spans of the job's trace are exported to
+type Tracing struct {
+	OTLPEndpoint string
+	OTLPHeaders  map[string]string
+	File         string
+}
+
+// Webhooks receive the lifecycle events of the job's VM
+type Webhooks struct {
+	URLs       []string
+	SecretPath string
+	Timeout    time.Duration
+	Attempts   int
+}
+
+// Retry tunes the retries of failed controller requests, zero values keep the defaults
+type Retry struct {
+	Attempts     int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// OAuth configures OAuth2 / OIDC bearer token authentication toward the controller
+type OAuth struct {
+	TokenURL         string
+	ClientId         string
+	ClientSecretPath string
+	Scopes           []string
+	// IdToken is the Gitlab job's ID token, read from the job variable named by ANKA_CLOUD_OAUTH_ID_TOKEN_VAR
+	IdToken string
+}
+
+func (o OAuth) Enabled() bool {
+	return o.TokenURL != "" || o.IdToken != ""
+}
+
+// SaveAsTag describes the template tag a successful job's VM is saved as
+type SaveAsTag struct {
+	Tag         string
+	Description string
+	Overwrite   bool
+	Timeout     time.Duration
+}
+
+// Diagnostics describes what to collect from the VM of a failed job, and where to store it
+type Diagnostics struct {
+	Paths         []string
+	Commands      []string
+	Dir           string
+	S3URL         string
+	S3Credentials string
+	Timeout       time.Duration
+}
+
+func (d Diagnostics) Enabled() bool {
+	return (len(d.Paths) > 0 || len(d.Commands) > 0) && (d.Dir != "" || d.S3URL != "")
+}
+
+const (
+	defaultKeepAliveDuration  = 2 * time.Hour
+	defaultTerminateTimeout   = 2 * time.Minute
+	defaultDiagnosticsTimeout = 5 * time.Minute
+	defaultSaveAsTagTimeout   = time.Hour
+	defaultCertExpiryWarning  = 14 * 24 * time.Hour
+)
+
 type jobStatus string
 
 var (
@@ -82,6 +289,7 @@ var (
 	JobStatusFailed   jobStatus = "failed"
 	JobStatusCanceled jobStatus = "canceled"
 	JobStatusRunning  jobStatus = "running"
+	JobStatusSkipped  jobStatus = "skipped"
 )
 
 var sshPassword = flag.String("ssh-password", "", "the password used to SSH into the VM")
@@ -96,15 +304,50 @@ func InitEnv() (Environment, error) {
 		SSHUserName: *sshUserName,
 	}
 
-	var ok bool
-	if e.ControllerURL, ok = os.LookupEnv(varControllerURL); !ok {
-		return e, fmt.Errorf("%w: %s", ErrMissingVar, varControllerURL)
+	e.Backend = BackendController
+	if backend := os.Getenv(varBackend); backend != "" {
+		if backend != BackendController && backend != BackendNode {
+			return e, fmt.Errorf("%w %q: must be %q or %q", ErrInvalidVar, varBackend, BackendController, BackendNode)
+		}
+		e.Backend = backend
 	}
-	e.ControllerURL = strings.TrimSuffix(e.ControllerURL, "/")
-	if !strings.HasPrefix(e.ControllerURL, "http") {
-		return e, fmt.Errorf("%w %q: missing http prefix", ErrInvalidVar, e.ControllerURL)
+
+	switch e.Backend {
+	case BackendController:
+		controllerURLs, ok := os.LookupEnv(varControllerURL)
+		if !ok {
+			return e, fmt.Errorf("%w: %s", ErrMissingVar, varControllerURL)
+		}
+		// a comma separated list of controllers sharing the same nodes, the first one is preferred
+		for _, controllerURL := range strings.Split(controllerURLs, ",") {
+			controllerURL = strings.TrimSuffix(strings.TrimSpace(controllerURL), "/")
+			if !strings.HasPrefix(controllerURL, "http") {
+				return e, fmt.Errorf("%w %q: missing http prefix", ErrInvalidVar, controllerURL)
+			}
+			e.ControllerURLs = append(e.ControllerURLs, controllerURL)
+		}
+		e.ControllerURL = e.ControllerURLs[0]
+	case BackendNode:
+		e.Node = Node{
+			Host:     os.Getenv(varNodeHost),
+			User:     os.Getenv(varNodeSshUserName),
+			Password: os.Getenv(varNodeSshPassword),
+			KeyPath:  os.Getenv(varNodeSshKeyPath),
+			HostKey:  os.Getenv(varNodeSshHostKey),
+			AnkaPath: os.Getenv(varNodeAnkaPath),
+		}
+		if e.Node.Host == "" {
+			return e, fmt.Errorf("%w: %s is required when %s is %q", ErrMissingVar, varNodeHost, varBackend, BackendNode)
+		}
+		if e.Node.User == "" {
+			return e, fmt.Errorf("%w: %s is required when %s is %q", ErrMissingVar, varNodeSshUserName, varBackend, BackendNode)
+		}
+		if e.Node.Password == "" && e.Node.KeyPath == "" {
+			return e, fmt.Errorf("%w: %s or %s is required when %s is %q", ErrMissingVar, varNodeSshKeyPath, varNodeSshPassword, varBackend, BackendNode)
+		}
 	}
 
+	var ok bool
 	if e.GitlabJobUrl, ok = os.LookupEnv(varGitlabJobUrl); !ok {
 		return e, fmt.Errorf("%w: %s", ErrMissingVar, varGitlabJobUrl)
 	}
@@ -124,9 +367,38 @@ func InitEnv() (Environment, error) {
 	e.CaCertPath = os.Getenv(varCaCertPath)
 	e.ClientCertPath = os.Getenv(varClientCertPath)
 	e.ClientCertKeyPath = os.Getenv(varClientCertKeyPath)
+	e.CaCertPEM = os.Getenv(varCaCertPEM)
+	e.ClientCertPEM = os.Getenv(varClientCertPEM)
+	e.ClientCertKeyPEM = os.Getenv(varClientCertKeyPEM)
+	e.ClientCertP12Path = os.Getenv(varClientCertP12Path)
+	e.ClientCertPassphrasePath = os.Getenv(varClientCertPassphrasePath)
+	e.TLSMinVersion = os.Getenv(varTLSMinVersion)
+	e.TLSCipherSuites = strings.FieldsFunc(os.Getenv(varTLSCipherSuites), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	e.UAKCredentialsPath = os.Getenv(varUAKCredentialsPath)
+	e.OAuth.TokenURL = os.Getenv(varOAuthTokenURL)
+	e.OAuth.ClientId = os.Getenv(varOAuthClientId)
+	e.OAuth.ClientSecretPath = os.Getenv(varOAuthClientSecretPath)
+	e.OAuth.Scopes = strings.FieldsFunc(os.Getenv(varOAuthScopes), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
 	e.GitlabJobStatus = jobStatus(os.Getenv(varGitlabJobStatus))
 	e.BuildsDir = os.Getenv(varBuildsDir)
 	e.CacheDir = os.Getenv(varCacheDir)
+	e.CommitTag = os.Getenv(varCommitTag)
+	e.CommitBranch = os.Getenv(varCommitBranch)
+	e.DefaultBranch = os.Getenv(varDefaultBranch)
+	e.PipelineSource = os.Getenv(varPipelineSource)
+	e.StateDir = os.Getenv(varStateDir)
+	e.ProjectId = os.Getenv(varProjectId)
+	e.PipelineId = os.Getenv(varPipelineId)
+	e.AuditLog.Path = os.Getenv(varAuditLogPath)
+	e.Metrics.TextfileDir = os.Getenv(varMetricsTextfileDir)
+	e.Metrics.PushURL = os.Getenv(varMetricsPushURL)
+	e.Tracing.OTLPEndpoint = os.Getenv(varTraceOTLPEndpoint)
+	e.Tracing.File = os.Getenv(varTraceFile)
+	e.Webhooks.SecretPath = os.Getenv(varWebhookSecretPath)
 
 	if priority, ok, err := GetIntEnvVar(varPriority); ok {
 		if err != nil {
@@ -135,18 +407,154 @@ func InitEnv() (Environment, error) {
 		e.Priority = priority
 	}
 
+	e.LogLevel = log.LevelInfo
 	if debug, ok, err := GetBoolEnvVar(varDebug); ok {
 		if err != nil {
 			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varDebug, err)
 		}
-		e.Debug = debug
+		if debug {
+			e.LogLevel = log.LevelDebug
+		}
+	}
+	if logLevel := os.Getenv(varLogLevel); logLevel != "" {
+		level, err := log.ParseLevel(logLevel)
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varLogLevel, err)
+		}
+		e.LogLevel = level
 	}
 
+	// quieter logging used to silence the Controller's progress details, which are now its components.
+	// It only trims info level progress: asking for debug output, with DEBUG or LOG_LEVEL, gets all of it
+	e.LogComponentLevels = map[log.Component]log.Level{}
 	if quietLogging, ok, err := GetBoolEnvVar(varQuietLogging); ok {
 		if err != nil {
 			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varQuietLogging, err)
 		}
-		e.QuietLogging = quietLogging
+		if quietLogging && e.LogLevel <= log.LevelInfo {
+			for _, component := range log.Components {
+				e.LogComponentLevels[component] = log.LevelWarn
+			}
+		}
+	}
+	if componentLevels := os.Getenv(varLogComponentLevels); componentLevels != "" {
+		for _, pair := range strings.Split(componentLevels, ",") {
+			name, value, found := strings.Cut(pair, "=")
+			component := log.Component(strings.TrimSpace(name))
+			if !found || !slices.Contains(log.Components, component) {
+				return e, fmt.Errorf("%w %q: expected comma separated <component>=<level> pairs, with components %v, got %q", ErrInvalidVar, varLogComponentLevels, log.Components, pair)
+			}
+			level, err := log.ParseLevel(value)
+			if err != nil {
+				return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varLogComponentLevels, err)
+			}
+			e.LogComponentLevels[component] = level
+		}
+	}
+
+	e.LogColor = true
+	if logColor, ok, err := GetBoolEnvVar(varLogColor); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varLogColor, err)
+		}
+		e.LogColor = logColor
+	}
+
+	e.TLSPins = strings.FieldsFunc(os.Getenv(varTLSPins), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+
+	e.CertExpiryWarning = defaultCertExpiryWarning
+	if days, ok, err := GetIntEnvVar(varCertExpiryWarningDays); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varCertExpiryWarningDays, err)
+		}
+		if days < 0 {
+			return e, fmt.Errorf("%w %q: must be 0 or higher", ErrInvalidVar, varCertExpiryWarningDays)
+		}
+		e.CertExpiryWarning = time.Duration(days) * 24 * time.Hour
+	}
+
+	if maxSize, ok, err := GetIntEnvVar(varAuditLogMaxSizeMb); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varAuditLogMaxSizeMb, err)
+		}
+		if maxSize < 1 {
+			return e, fmt.Errorf("%w %q: must be 1 or higher", ErrInvalidVar, varAuditLogMaxSizeMb)
+		}
+		e.AuditLog.MaxSizeMb = maxSize
+	}
+	if maxFiles, ok, err := GetIntEnvVar(varAuditLogMaxFiles); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varAuditLogMaxFiles, err)
+		}
+		if maxFiles < 1 {
+			return e, fmt.Errorf("%w %q: must be 1 or higher", ErrInvalidVar, varAuditLogMaxFiles)
+		}
+		e.AuditLog.MaxFiles = maxFiles
+	}
+
+	if e.Metrics.PushURL != "" {
+		if _, err := url.ParseRequestURI(e.Metrics.PushURL); err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varMetricsPushURL, err)
+		}
+		// the totals pushed are kept on the runner host, as each stage only knows about itself
+		if e.Metrics.TextfileDir == "" && e.StateDir == "" {
+			return e, fmt.Errorf("%w: %s or %s is required when %s is set", ErrMissingVar, varMetricsTextfileDir, varStateDir, varMetricsPushURL)
+		}
+	}
+
+	if e.Tracing.OTLPEndpoint != "" {
+		if _, err := url.ParseRequestURI(e.Tracing.OTLPEndpoint); err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varTraceOTLPEndpoint, err)
+		}
+	}
+	if headers, ok := os.LookupEnv(varTraceOTLPHeaders); ok {
+		if err := json.Unmarshal([]byte(headers), &e.Tracing.OTLPHeaders); err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varTraceOTLPHeaders, err)
+		}
+	}
+
+	for _, webhookURL := range strings.Split(os.Getenv(varWebhookURLs), ",") {
+		webhookURL = strings.TrimSpace(webhookURL)
+		if webhookURL == "" {
+			continue
+		}
+		if _, err := url.ParseRequestURI(webhookURL); err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varWebhookURLs, err)
+		}
+		e.Webhooks.URLs = append(e.Webhooks.URLs, webhookURL)
+	}
+	if len(e.Webhooks.URLs) > 0 && e.Webhooks.SecretPath == "" {
+		return e, fmt.Errorf("%w: %s is required when %s is set", ErrMissingVar, varWebhookSecretPath, varWebhookURLs)
+	}
+	if webhookTimeout, ok, err := GetDurationEnvVar(varWebhookTimeout); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varWebhookTimeout, err)
+		}
+		if webhookTimeout <= 0 {
+			return e, fmt.Errorf("%w %q: must be positive", ErrInvalidVar, varWebhookTimeout)
+		}
+		e.Webhooks.Timeout = webhookTimeout
+	}
+	if webhookAttempts, ok, err := GetIntEnvVar(varWebhookAttempts); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varWebhookAttempts, err)
+		}
+		if webhookAttempts < 1 {
+			return e, fmt.Errorf("%w %q: must be 1 or higher", ErrInvalidVar, varWebhookAttempts)
+		}
+		e.Webhooks.Attempts = webhookAttempts
+	}
+
+	switch e.TLSMinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return e, fmt.Errorf("%w %q: must be one of 1.0, 1.1, 1.2 or 1.3", ErrInvalidVar, varTLSMinVersion)
+	}
+
+	if e.ClientCertP12Path != "" && (e.ClientCertPath != "" || e.ClientCertPEM != "") {
+		return e, fmt.Errorf("%w: %s and a PEM client certificate are mutually exclusive", ErrInvalidVar, varClientCertP12Path)
 	}
 
 	if skip, ok, err := GetBoolEnvVar(varSkipTLSVerify); ok {
@@ -156,6 +564,46 @@ func InitEnv() (Environment, error) {
 		e.SkipTLSVerify = skip
 	}
 
+	if attempts, ok, err := GetIntEnvVar(varRetryAttempts); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varRetryAttempts, err)
+		}
+		if attempts < 1 {
+			return e, fmt.Errorf("%w %q: must be 1 or higher", ErrInvalidVar, varRetryAttempts)
+		}
+		e.Retry.Attempts = attempts
+	}
+	if initialDelay, ok, err := GetDurationEnvVar(varRetryInitialDelay); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varRetryInitialDelay, err)
+		}
+		if initialDelay < 0 {
+			return e, fmt.Errorf("%w %q: must not be negative", ErrInvalidVar, varRetryInitialDelay)
+		}
+		e.Retry.InitialDelay = initialDelay
+	}
+	if maxDelay, ok, err := GetDurationEnvVar(varRetryMaxDelay); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varRetryMaxDelay, err)
+		}
+		if maxDelay < 0 {
+			return e, fmt.Errorf("%w %q: must not be negative", ErrInvalidVar, varRetryMaxDelay)
+		}
+		e.Retry.MaxDelay = maxDelay
+	}
+
+	e.ProxyURL = os.Getenv(varProxyURL)
+	e.NoProxy = os.Getenv(varNoProxy)
+	if sshViaProxy, ok, err := GetBoolEnvVar(varSshViaProxy); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varSshViaProxy, err)
+		}
+		if sshViaProxy && e.ProxyURL == "" {
+			return e, fmt.Errorf("%w: %s is required when %s is set", ErrMissingVar, varProxyURL, varSshViaProxy)
+		}
+		e.SSHViaProxy = sshViaProxy
+	}
+
 	if customHttpHeaders, ok := os.LookupEnv(varCustomHTTPHeaders); ok {
 		err := json.Unmarshal([]byte(customHttpHeaders), &e.CustomHttpHeaders)
 		if err != nil {
@@ -170,6 +618,107 @@ func InitEnv() (Environment, error) {
 		e.KeepAliveOnError = keepAlive
 	}
 
+	e.KeepAliveDuration = defaultKeepAliveDuration
+	if keepAliveDuration, ok, err := GetDurationEnvVar(varKeepAliveDuration); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varKeepAliveDuration, err)
+		}
+		if keepAliveDuration <= 0 {
+			return e, fmt.Errorf("%w %q: must be a positive duration", ErrInvalidVar, varKeepAliveDuration)
+		}
+		e.KeepAliveDuration = keepAliveDuration
+	}
+
+	if keepAliveMax, ok, err := GetIntEnvVar(varKeepAliveMaxPerProject); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varKeepAliveMaxPerProject, err)
+		}
+		if keepAliveMax < 0 {
+			return e, fmt.Errorf("%w %q: must be 0 or higher", ErrInvalidVar, varKeepAliveMaxPerProject)
+		}
+		e.KeepAliveMaxPerProject = keepAliveMax
+	}
+
+	e.TerminateTimeout = defaultTerminateTimeout
+	if terminateTimeout, ok, err := GetDurationEnvVar(varTerminateTimeout); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varTerminateTimeout, err)
+		}
+		if terminateTimeout < 0 {
+			return e, fmt.Errorf("%w %q: must not be negative", ErrInvalidVar, varTerminateTimeout)
+		}
+		e.TerminateTimeout = terminateTimeout
+	}
+
+	if paths, ok := os.LookupEnv(varDiagnosticsPaths); ok {
+		if err := json.Unmarshal([]byte(paths), &e.Diagnostics.Paths); err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varDiagnosticsPaths, err)
+		}
+	}
+
+	if commands, ok := os.LookupEnv(varDiagnosticsCommands); ok {
+		if err := json.Unmarshal([]byte(commands), &e.Diagnostics.Commands); err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varDiagnosticsCommands, err)
+		}
+	}
+
+	e.Diagnostics.Dir = os.Getenv(varDiagnosticsDir)
+	e.Diagnostics.S3URL = strings.TrimSuffix(os.Getenv(varDiagnosticsS3URL), "/")
+	e.Diagnostics.S3Credentials = os.Getenv(varDiagnosticsS3Credentials)
+	if e.Diagnostics.S3URL != "" && e.Diagnostics.S3Credentials == "" {
+		return e, fmt.Errorf("%w: %s is required when %s is set", ErrMissingVar, varDiagnosticsS3Credentials, varDiagnosticsS3URL)
+	}
+
+	e.Diagnostics.Timeout = defaultDiagnosticsTimeout
+	if diagnosticsTimeout, ok, err := GetDurationEnvVar(varDiagnosticsTimeout); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varDiagnosticsTimeout, err)
+		}
+		if diagnosticsTimeout <= 0 {
+			return e, fmt.Errorf("%w %q: must be a positive duration", ErrInvalidVar, varDiagnosticsTimeout)
+		}
+		e.Diagnostics.Timeout = diagnosticsTimeout
+	}
+
+	e.SaveAsTag.Tag = os.Getenv(varSaveAsTag)
+	e.SaveAsTag.Description = os.Getenv(varSaveAsTagDescription)
+
+	if overwrite, ok, err := GetBoolEnvVar(varSaveAsTagOverwrite); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varSaveAsTagOverwrite, err)
+		}
+		e.SaveAsTag.Overwrite = overwrite
+	}
+
+	e.SaveAsTag.Timeout = defaultSaveAsTagTimeout
+	if saveAsTagTimeout, ok, err := GetDurationEnvVar(varSaveAsTagTimeout); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varSaveAsTagTimeout, err)
+		}
+		if saveAsTagTimeout <= 0 {
+			return e, fmt.Errorf("%w %q: must be a positive duration", ErrInvalidVar, varSaveAsTagTimeout)
+		}
+		e.SaveAsTag.Timeout = saveAsTagTimeout
+	}
+
+	if idTokenVar := os.Getenv(varOAuthIdTokenVar); idTokenVar != "" {
+		e.OAuth.IdToken = os.Getenv(gitlabVar(idTokenVar))
+		if e.OAuth.IdToken == "" {
+			return e, fmt.Errorf("%w: job variable %q named by %s is empty, is it declared in the job's id_tokens?", ErrMissingVar, idTokenVar, varOAuthIdTokenVar)
+		}
+	}
+	if e.OAuth.TokenURL != "" {
+		if e.OAuth.ClientId == "" {
+			return e, fmt.Errorf("%w: %s is required when %s is set", ErrMissingVar, varOAuthClientId, varOAuthTokenURL)
+		}
+		if e.OAuth.ClientSecretPath == "" && e.OAuth.IdToken == "" {
+			return e, fmt.Errorf("%w: %s or %s is required when %s is set", ErrMissingVar, varOAuthClientSecretPath, varOAuthIdTokenVar, varOAuthTokenURL)
+		}
+	}
+	if e.OAuth.Enabled() && e.UAKCredentialsPath != "" {
+		return e, fmt.Errorf("%w: %s and OAuth authentication are mutually exclusive", ErrInvalidVar, varUAKCredentialsPath)
+	}
+
 	if vram, ok, err := GetIntEnvVar(varVmVramMb); ok {
 		if err != nil {
 			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varVmVramMb, err)
@@ -204,6 +753,48 @@ func InitEnv() (Environment, error) {
 		e.SSHConnectionAttemptDelay = sshConnectionAttemptDelay
 	}
 
+	if priorityRules, ok := os.LookupEnv(varPriorityRules); ok {
+		var rules PriorityRules
+		if err := json.Unmarshal([]byte(priorityRules), &rules); err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varPriorityRules, err)
+		}
+		if err := rules.validate(); err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varPriorityRules, err)
+		}
+		e.PriorityRules = &rules
+	}
+
+	if interval, ok, err := GetDurationEnvVar(varPriorityAgeBoostInterval); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varPriorityAgeBoostInterval, err)
+		}
+		if interval <= 0 {
+			return e, fmt.Errorf("%w %q: must be a positive duration", ErrInvalidVar, varPriorityAgeBoostInterval)
+		}
+		e.PriorityAgeBoost.Interval = interval
+	}
+
+	if step, ok, err := GetIntEnvVar(varPriorityAgeBoostStep); ok {
+		if err != nil {
+			return e, fmt.Errorf("%w %q: %w", ErrInvalidVar, varPriorityAgeBoostStep, err)
+		}
+		if step < 1 {
+			return e, fmt.Errorf("%w %q: must be 1 or higher", ErrInvalidVar, varPriorityAgeBoostStep)
+		}
+		e.PriorityAgeBoost.Step = step
+	}
+
+	// set by Gitlab, so a malformed value should never fail the job
+	if protected, ok, err := GetBoolEnvVar(varCommitRefProtected); ok && err == nil {
+		e.CommitRefProtected = protected
+	}
+
+	if createdAt, ok := os.LookupEnv(varPipelineCreatedAt); ok {
+		if t, err := time.Parse(time.RFC3339, createdAt); err == nil {
+			e.PipelineCreatedAt = t
+		}
+	}
+
 	return e, nil
 }
 
@@ -215,6 +806,11 @@ func ankaVar(name string) string {
 	return gitlabVar(fmt.Sprintf("%s%s", prefixAnkaCloudEnvVar, name))
 }
 
+// runnerVar is read from the environment of the runner process itself, which jobs can't change
+func runnerVar(name string) string {
+	return fmt.Sprintf("%s%s", prefixAnkaCloudEnvVar, name)
+}
+
 func GetBoolEnvVar(name string) (bool, bool, error) {
 	v, ok := os.LookupEnv(name)
 	if !ok {
@@ -242,3 +838,17 @@ func GetIntEnvVar(name string) (int, bool, error) {
 
 	return n, true, nil
 }
+
+func GetDurationEnvVar(name string) (time.Duration, bool, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return 0, false, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, true, fmt.Errorf("failed to convert variable %s with value %q to duration: %w", name, v, err)
+	}
+
+	return d, true, nil
+}
@@ -5,6 +5,8 @@ import (
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
 )
 
 func TestControllerWithTrailingSlash(t *testing.T) {
@@ -22,6 +24,82 @@ func TestControllerWithTrailingSlash(t *testing.T) {
 	}
 }
 
+func TestMultipleControllerURLs(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-1/, https://fake-controller-2:8090")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	defer os.Clearenv()
+
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"http://fake-controller-1", "https://fake-controller-2:8090"}
+	if strings.Join(env.ControllerURLs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected controller urls %q, got %q", expected, env.ControllerURLs)
+	}
+	if env.ControllerURL != expected[0] {
+		t.Errorf("expected primary controller url %q, got %q", expected[0], env.ControllerURL)
+	}
+}
+
+func TestNodeBackend(t *testing.T) {
+	os.Setenv(varBackend, BackendNode)
+	os.Setenv(varNodeHost, "mac-1.lab:2222")
+	os.Setenv(varNodeSshUserName, "ci")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	defer os.Clearenv()
+
+	_, err := InitEnv()
+	if !errors.Is(err, ErrMissingVar) {
+		t.Errorf("expected missing var error without node credentials, got %v", err)
+	}
+
+	os.Setenv(varNodeSshKeyPath, "/etc/anka/node_key")
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Backend != BackendNode || env.Node.Host != "mac-1.lab:2222" || env.ControllerURL != "" {
+		t.Errorf("unexpected environment %+v", env)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-url")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	os.Setenv(varDebug, "true")
+	os.Setenv(varQuietLogging, "true")
+	os.Setenv(varLogComponentLevels, "http=trace")
+	defer os.Clearenv()
+
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.LogLevel != log.LevelDebug {
+		t.Errorf("expected debug level, got %s", env.LogLevel)
+	}
+	if _, ok := env.LogComponentLevels[log.Controller]; env.LogComponentLevels[log.HTTP] != log.LevelTrace || ok {
+		t.Errorf("expected quieter logging to be ignored with debug on, got component levels %v", env.LogComponentLevels)
+	}
+
+	os.Setenv(varDebug, "false")
+	if env, err = InitEnv(); err != nil || env.LogComponentLevels[log.HTTP] != log.LevelTrace || env.LogComponentLevels[log.Controller] != log.LevelWarn {
+		t.Errorf("unexpected component levels %v, %v", env.LogComponentLevels, err)
+	}
+
+	os.Setenv(varLogLevel, "error")
+	if env, err = InitEnv(); err != nil || env.LogLevel != log.LevelError {
+		t.Errorf("expected log level to win over debug, got %s, %v", env.LogLevel, err)
+	}
+
+	os.Setenv(varLogComponentLevels, "disk=debug")
+	if _, err := InitEnv(); !errors.Is(err, ErrInvalidVar) {
+		t.Errorf("expected invalid var error for unknown component, got %v", err)
+	}
+}
+
 func TestCustomHttpHeadersEnvVar(t *testing.T) {
 	os.Setenv(varControllerURL, "http://fake-controller-url")
 	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
@@ -153,3 +231,112 @@ func TestInvalidVcpu(t *testing.T) {
 		}
 	}
 }
+
+func TestAuditLogFromRunnerEnvironment(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-url")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	os.Setenv(ankaVar("AUDIT_LOG_PATH"), "/tmp/job-chosen.log")
+	defer os.Clearenv()
+
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.AuditLog.Path != "" {
+		t.Errorf("expected job variable to be ignored, got audit log path %q", env.AuditLog.Path)
+	}
+
+	os.Setenv("ANKA_CLOUD_AUDIT_LOG_PATH", "/var/log/anka-gle/audit.log")
+	if env, err = InitEnv(); err != nil || env.AuditLog.Path != "/var/log/anka-gle/audit.log" {
+		t.Errorf("expected audit log path of the runner environment, got %q, %v", env.AuditLog.Path, err)
+	}
+}
+
+func TestWebhookSecretRequired(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-url")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	os.Setenv(varWebhookURLs, "https://hooks.example.com/anka")
+	defer os.Clearenv()
+
+	if _, err := InitEnv(); !errors.Is(err, ErrMissingVar) {
+		t.Errorf("expected error %q, got %v", ErrMissingVar, err)
+	}
+
+	os.Setenv(varWebhookSecretPath, "/etc/anka-gle/webhook-secret")
+	if _, err := InitEnv(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestOAuthFromRunnerEnvironment(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-url")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	os.Setenv(ankaVar("OAUTH_TOKEN_URL"), "https://attacker.example.com/token")
+	os.Setenv(ankaVar("OAUTH_CLIENT_ID"), "job-client")
+	os.Setenv(ankaVar("OAUTH_CLIENT_SECRET_PATH"), "/etc/shadow")
+	os.Setenv(varOAuthScopes, "anka.read")
+	defer os.Clearenv()
+
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.OAuth.TokenURL != "" || env.OAuth.ClientId != "" || env.OAuth.ClientSecretPath != "" {
+		t.Errorf("expected job variables to be ignored, got %+v", env.OAuth)
+	}
+
+	os.Setenv("ANKA_CLOUD_OAUTH_TOKEN_URL", "https://idp.example.com/token")
+	os.Setenv("ANKA_CLOUD_OAUTH_CLIENT_ID", "runner-client")
+	os.Setenv("ANKA_CLOUD_OAUTH_CLIENT_SECRET_PATH", "/etc/anka-gle/oauth-secret")
+	if env, err = InitEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if env.OAuth.TokenURL != "https://idp.example.com/token" || env.OAuth.ClientId != "runner-client" || env.OAuth.ClientSecretPath != "/etc/anka-gle/oauth-secret" {
+		t.Errorf("expected OAuth settings of the runner environment, got %+v", env.OAuth)
+	}
+	if len(env.OAuth.Scopes) != 1 || env.OAuth.Scopes[0] != "anka.read" {
+		t.Errorf("expected scopes of the job, got %v", env.OAuth.Scopes)
+	}
+}
+
+func TestUAKCredentialsFromRunnerEnvironment(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-url")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	os.Setenv(ankaVar("UAK_CREDENTIALS_PATH"), "/home/gitlab-runner/.ssh/id_rsa")
+	defer os.Clearenv()
+
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.UAKCredentialsPath != "" {
+		t.Errorf("expected job variable to be ignored, got UAK credentials path %q", env.UAKCredentialsPath)
+	}
+
+	os.Setenv("ANKA_CLOUD_UAK_CREDENTIALS_PATH", "/etc/anka-gle/uak.json")
+	if env, err = InitEnv(); err != nil || env.UAKCredentialsPath != "/etc/anka-gle/uak.json" {
+		t.Errorf("expected UAK credentials path of the runner environment, got %q, %v", env.UAKCredentialsPath, err)
+	}
+}
+
+func TestDiagnosticsStorageFromRunnerEnvironment(t *testing.T) {
+	os.Setenv(varControllerURL, "http://fake-controller-url")
+	os.Setenv(varGitlabJobUrl, "fake-gitlab-job-url")
+	os.Setenv(varDiagnosticsPaths, `["~/Library/Logs/DiagnosticReports"]`)
+	os.Setenv(ankaVar("DIAGNOSTICS_DIR"), "/etc/cron.d")
+	os.Setenv(ankaVar("DIAGNOSTICS_S3_CREDENTIALS_PATH"), "/home/gitlab-runner/.aws/credentials")
+	defer os.Clearenv()
+
+	env, err := InitEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Diagnostics.Dir != "" || env.Diagnostics.S3Credentials != "" {
+		t.Errorf("expected job variables to be ignored, got %+v", env.Diagnostics)
+	}
+
+	os.Setenv("ANKA_CLOUD_DIAGNOSTICS_DIR", "/var/lib/anka-gle/diagnostics")
+	if env, err = InitEnv(); err != nil || env.Diagnostics.Dir != "/var/lib/anka-gle/diagnostics" || !env.Diagnostics.Enabled() {
+		t.Errorf("expected diagnostics dir of the runner environment, got %+v, %v", env.Diagnostics, err)
+	}
+}
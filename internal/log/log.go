@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
+	"sync"
 )
 
 const (
@@ -20,27 +22,111 @@ const (
 	CLEAR        = "\033[0K"
 )
 
-var debug bool
-var quietLogging bool
+// Level is the verbosity of a message, a message is logged if its level is at most the configured one
+type Level int
 
-func SetDebug(active bool) {
-	debug = active
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	if l < LevelError || l > LevelTrace {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if name == "warning" {
+		name = "warn"
+	}
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// Component is a part of the executor whose level can be set apart from the rest
+type Component string
+
+const (
+	// HTTP is the Controller API client: requests, retries and, at trace level, request and response bodies
+	HTTP Component = "http"
+	// SSH is the connection to the VM and to the node
+	SSH Component = "ssh"
+	// Controller is the backend managing the instances: instance states, pulling progress, TLS setup
+	Controller Component = "controller"
+)
+
+var Components = []Component{HTTP, SSH, Controller}
+
+var (
+	mu              sync.RWMutex
+	level           = LevelInfo
+	componentLevels = map[Component]Level{}
+	color           = true
+)
+
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
 }
 
-func SetQuietLogging(active bool) {
-	quietLogging = active
+// SetComponentLevel overrides the level of messages of the component
+func SetComponentLevel(c Component, l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	componentLevels[c] = l
+}
+
+// SetColor toggles ANSI colours, for log sinks that are not terminals
+func SetColor(active bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	color = active
+}
+
+// Enabled tells whether messages of the level are logged, to skip building expensive ones
+func Enabled(l Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return l <= level
 }
 
 func SetOutput(w io.Writer) {
 	log.SetOutput(w)
 }
 
+// output is the single way to the log, so everything written is redacted
+func output(s string) {
+	log.Print(Redact(s))
+}
+
+func colorize(c string, s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if !color {
+		return s
+	}
+	return c + s + RESET
+}
+
 func Printf(format string, v ...any) {
-	log.Printf(format, v...)
+	logf("", LevelInfo, format, v...)
 }
 
 func Println(v ...any) {
-	log.Println(v...)
+	logf("", LevelInfo, "%s", fmt.Sprintln(v...))
 }
 
 func Debugln(v ...any) {
@@ -48,67 +134,94 @@ func Debugln(v ...any) {
 }
 
 func Debugf(format string, v ...any) {
-	if debug {
-		log.Printf(fmt.Sprintf("DEBUG: %s", format), v...)
-	}
+	logf("", LevelDebug, format, v...)
+}
+
+func Tracef(format string, v ...any) {
+	logf("", LevelTrace, format, v...)
 }
 
 func Warnf(format string, v ...any) {
-	log.Printf("%sWARN: %s%s", BOLD_YELLOW, fmt.Sprintf(format, v...), RESET)
+	logf("", LevelWarn, format, v...)
 }
 
 func Warnln(v ...any) {
-	log.Printf("%sWARN: %s%s", BOLD_YELLOW, fmt.Sprint(v...), RESET)
+	logf("", LevelWarn, "%s", fmt.Sprint(v...))
 }
 
-func ConditionalWarnf(format string, v ...any) {
-	if !quietLogging {
-		Warnf(format, v...)
-	}
+func Errorf(format string, v ...any) {
+	logf("", LevelError, format, v...)
 }
 
-func ConditionalWarnln(v ...any) {
-	if !quietLogging {
-		Warnln(v...)
-	}
+func Errorln(v ...any) {
+	logf("", LevelError, "%s", fmt.Sprint(v...))
 }
 
-func Errorf(format string, v ...any) {
-	log.Printf("%sERROR: %s%s", BOLD_RED, fmt.Sprintf(format, v...), RESET)
+func Colorf(format string, v ...any) {
+	if Enabled(LevelInfo) {
+		output(colorize(BOLD_MAGENTA, fmt.Sprintf(format, v...)))
+	}
 }
 
-func Errorln(v ...any) {
-	log.Printf("%sERROR: %s%s", BOLD_RED, fmt.Sprint(v...), RESET)
+func Colorln(v ...any) {
+	if Enabled(LevelInfo) {
+		output(colorize(BOLD_MAGENTA, fmt.Sprint(v...)))
+	}
 }
 
-func ConditionalErrorf(format string, v ...any) {
-	if !quietLogging {
-		Errorf(format, v...)
+// Enabled tells whether messages of the level are logged for the component
+func (c Component) Enabled(l Level) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	if componentLevel, ok := componentLevels[c]; ok {
+		return l <= componentLevel
 	}
+	return l <= level
 }
 
-func ConditionalErrorln(v ...any) {
-	if !quietLogging {
-		Errorln(v...)
+func (c Component) Colorf(format string, v ...any) {
+	if c.Enabled(LevelInfo) {
+		output(colorize(BOLD_MAGENTA, fmt.Sprintf(format, v...)))
 	}
 }
 
-func Colorf(format string, v ...any) {
-	log.Printf("%s%s%s", BOLD_MAGENTA, fmt.Sprintf(format, v...), RESET)
+func (c Component) Printf(format string, v ...any) {
+	logf(c, LevelInfo, format, v...)
 }
 
-func Colorln(v ...any) {
-	log.Printf("%s%s%s", BOLD_MAGENTA, fmt.Sprint(v...), RESET)
+func (c Component) Debugf(format string, v ...any) {
+	logf(c, LevelDebug, format, v...)
 }
 
-func ConditionalColorf(format string, v ...any) {
-	if !quietLogging {
-		Colorf(format, v...)
+func (c Component) Tracef(format string, v ...any) {
+	logf(c, LevelTrace, format, v...)
+}
+
+func (c Component) Warnf(format string, v ...any) {
+	logf(c, LevelWarn, format, v...)
+}
+
+func logf(c Component, l Level, format string, v ...any) {
+	if c.Enabled(l) {
+		output(decorate(c, l, fmt.Sprintf(format, v...)))
 	}
 }
 
-func ConditionalColorln(v ...any) {
-	if !quietLogging {
-		Colorln(v...)
+// decorate prefixes the message with its level, and the component it comes from
+func decorate(c Component, l Level, s string) string {
+	tag := ""
+	if c != "" {
+		tag = fmt.Sprintf("[%s] ", c)
+	}
+	switch l {
+	case LevelError:
+		return colorize(BOLD_RED, "ERROR: "+tag+s)
+	case LevelWarn:
+		return colorize(BOLD_YELLOW, "WARN: "+tag+s)
+	case LevelDebug:
+		return "DEBUG: " + tag + s
+	case LevelTrace:
+		return "TRACE: " + tag + s
 	}
+	return tag + s
 }
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Level
+	}{
+		{"error", LevelError},
+		{"WARN", LevelWarn},
+		{"warning", LevelWarn},
+		{" info ", LevelInfo},
+		{"debug", LevelDebug},
+		{"trace", LevelTrace},
+	} {
+		got, err := ParseLevel(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseLevel(%q) = %s, %v, want %s", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(LevelWarn)
+	SetComponentLevel(HTTP, LevelTrace)
+	defer func() {
+		SetLevel(LevelInfo)
+		componentLevels = map[Component]Level{}
+	}()
+
+	Errorf("error message")
+	Warnf("warn message")
+	Printf("info message")
+	Colorf("color message")
+	Debugf("debug message")
+	HTTP.Tracef("http body")
+	SSH.Debugf("ssh message")
+	Controller.Colorf("instance state")
+
+	out := buf.String()
+	for _, expected := range []string{"ERROR: error message", "WARN: warn message", "TRACE: [http] http body"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in output:\n%s", expected, out)
+		}
+	}
+	for _, unexpected := range []string{"info message", "color message", "debug message", "ssh message", "instance state"} {
+		if strings.Contains(out, unexpected) {
+			t.Errorf("unexpected %q in output:\n%s", unexpected, out)
+		}
+	}
+}
+
+func TestColor(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetColor(false)
+	defer SetColor(true)
+
+	Warnf("warn message")
+	Colorf("color message")
+	if strings.Contains(buf.String(), "\033[") {
+		t.Errorf("expected no ANSI escapes, got %q", buf.String())
+	}
+}
+
+func TestSection(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+
+	section := StartSection("pulling template", "Pulling template %s", "macos-14")
+	Colorf("pulling progress: 50%%\n")
+	section.End("template %s pulled", "macos-14")
+	section.End("ended twice")
+
+	out := buf.String()
+	start := regexp.MustCompile(`\x1b\[0Ksection_start:\d+:(anka_pulling_template_\d+)\[collapsed=true\]\r\x1b\[0K.*Pulling template macos-14`).FindStringSubmatch(out)
+	if start == nil {
+		t.Fatalf("expected collapsed section start, got %q", out)
+	}
+	if !regexp.MustCompile(`\x1b\[0Ksection_end:\d+:` + start[1] + `\r\x1b\[0K`).MatchString(out) {
+		t.Errorf("expected section end of %s, got %q", start[1], out)
+	}
+	if !regexp.MustCompile(`template macos-14 pulled \(\d.*s\)`).MatchString(out) {
+		t.Errorf("expected summary with duration, got %q", out)
+	}
+	if strings.Contains(out, "ended twice") {
+		t.Errorf("expected a single end, got %q", out)
+	}
+
+	buf.Reset()
+	SetColor(false)
+	defer SetColor(true)
+	StartSection("cleanup", "Terminating instances").End("terminated")
+	if strings.Contains(buf.String(), "section_") {
+		t.Errorf("expected no section markers without colours, got %q", buf.String())
+	}
+}
@@ -0,0 +1,64 @@
+package log
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Section groups the lines logged until End in a collapsed section of the GitLab job log
+// (https://docs.gitlab.com/ee/ci/jobs/job_logs.html#custom-collapsible-sections). The header is the
+// collapsed line, End leaves a one-line summary with the section's duration visible below it.
+// Without colours the markers are left out, as they are escape sequences too.
+type Section struct {
+	name   string
+	header string
+	start  time.Time
+	ended  bool
+}
+
+var invalidSectionName = regexp.MustCompile(`[^a-z0-9_.-]`)
+
+// StartSection opens a collapsed section, name only needs to be unique among sections open at once
+func StartSection(name string, format string, v ...any) *Section {
+	s := &Section{
+		header: fmt.Sprintf(format, v...),
+		start:  time.Now(),
+	}
+	// GitLab matches the end marker to the start marker by name, so make it unique in the job
+	s.name = fmt.Sprintf("anka_%s_%d", invalidSectionName.ReplaceAllString(name, "_"), s.start.UnixNano())
+
+	if !Enabled(LevelInfo) {
+		return s
+	}
+	if sectionsEnabled() {
+		output(fmt.Sprintf("%ssection_start:%d:%s[collapsed=true]\r%s%s", CLEAR, s.start.Unix(), s.name, CLEAR, colorize(BOLD_CYAN, s.header)))
+	} else {
+		output(s.header)
+	}
+	return s
+}
+
+// End closes the section with a summary of its outcome. It does nothing on a section that already ended,
+// so it can be deferred for the error paths after being called on success.
+func (s *Section) End(format string, v ...any) {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	if !Enabled(LevelInfo) {
+		return
+	}
+
+	now := time.Now()
+	if sectionsEnabled() {
+		output(fmt.Sprintf("%ssection_end:%d:%s\r%s", CLEAR, now.Unix(), s.name, CLEAR))
+	}
+	output(colorize(BOLD_MAGENTA, fmt.Sprintf("%s (%s)", fmt.Sprintf(format, v...), now.Sub(s.start).Round(100*time.Millisecond))))
+}
+
+func sectionsEnabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return color
+}
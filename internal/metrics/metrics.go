@@ -0,0 +1,386 @@
+// Package metrics records how long jobs wait for their VM and how the stages go, in the Prometheus
+// text format. Stages are short lived processes, so each one merges its samples into totals kept on
+// the runner host, then writes them to a node exporter textfile collector directory or pushes them to
+// a Pushgateway. Nothing here returns an error to the stage: a failed write or push only loses samples.
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/filelock"
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+const namespace = "anka_cloud_gitlab_executor"
+
+const (
+	QueueSeconds       = namespace + "_queue_seconds"
+	PullSeconds        = namespace + "_pull_seconds"
+	BootSeconds        = namespace + "_boot_seconds"
+	SSHConnectAttempts = namespace + "_ssh_connect_attempts"
+	SSHConnectSeconds  = namespace + "_ssh_connect_seconds"
+	RunStageSeconds    = namespace + "_run_stage_seconds"
+	TerminateSeconds   = namespace + "_terminate_seconds"
+	ErrorsTotal        = namespace + "_errors_total"
+)
+
+const (
+	textfileName = namespace + ".prom"
+	stateName    = "." + namespace + ".json"
+	pushTimeout  = 5 * time.Second
+)
+
+var (
+	secondsBuckets  = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+	attemptsBuckets = []float64{1, 2, 3, 4, 5, 10}
+)
+
+type definition struct {
+	help    string
+	buckets []float64 // nil for counters
+}
+
+var definitions = map[string]definition{
+	QueueSeconds:       {"Time instances spent waiting for a node to be scheduled on.", secondsBuckets},
+	PullSeconds:        {"Time spent pulling the template to the node.", secondsBuckets},
+	BootSeconds:        {"Time VMs took to boot, on the node backend.", secondsBuckets},
+	SSHConnectAttempts: {"Attempts needed to connect to the VM over SSH.", attemptsBuckets},
+	SSHConnectSeconds:  {"Time taken to connect to the VM over SSH.", secondsBuckets},
+	RunStageSeconds:    {"Duration of the run stages, by GitLab run stage.", secondsBuckets},
+	TerminateSeconds:   {"Time from requesting the termination of an instance to its confirmation.", secondsBuckets},
+	ErrorsTotal:        {"Failed stages, by stage and error category. Failures of the job script are not counted.", nil},
+}
+
+// Labels are carried by every metric. Totals are kept forever, so they only hold values with a bound,
+// unlike the tag of the template, which every job can pick.
+type Labels struct {
+	Template   string
+	NodeGroup  string
+	Controller string
+}
+
+type Config struct {
+	// TextfileDir is the node exporter textfile collector directory
+	TextfileDir string
+	// PushURL is the Pushgateway base URL
+	PushURL string
+	// StateDir keeps the totals, in a metrics subdirectory, when there is no textfile directory
+	StateDir string
+}
+
+// enabled tells whether there is a sink, and somewhere to keep the totals
+func (c Config) enabled() bool {
+	return c.TextfileDir != "" || (c.PushURL != "" && c.StateDir != "")
+}
+
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// series is a metric with a set of labels, and its totals across processes
+type series struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value,omitempty"`
+	// Buckets counts observations per bucket, not cumulated
+	Buckets []uint64 `json:"buckets,omitempty"`
+	Sum     float64  `json:"sum,omitempty"`
+	Count   uint64   `json:"count,omitempty"`
+}
+
+var (
+	mu      sync.Mutex
+	config  Config
+	labels  Labels
+	pending []sample
+)
+
+func Init(c Config, l Labels) {
+	mu.Lock()
+	defer mu.Unlock()
+	config = c
+	labels = l
+	pending = nil
+}
+
+// Update changes the labels of the following samples, like the controller once it is selected
+func Update(fn func(labels *Labels)) {
+	mu.Lock()
+	defer mu.Unlock()
+	fn(&labels)
+}
+
+// Observe adds a value to a histogram, extra labels are given as name and value pairs
+func Observe(name string, value float64, extraLabels ...string) {
+	add(name, value, extraLabels)
+}
+
+// Inc increments a counter, extra labels are given as name and value pairs
+func Inc(name string, extraLabels ...string) {
+	add(name, 1, extraLabels)
+}
+
+func add(name string, value float64, extraLabels []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !config.enabled() {
+		return
+	}
+
+	sampleLabels := map[string]string{
+		"template":   labels.Template,
+		"node_group": labels.NodeGroup,
+		"controller": labels.Controller,
+	}
+	for i := 0; i+1 < len(extraLabels); i += 2 {
+		sampleLabels[extraLabels[i]] = extraLabels[i+1]
+	}
+	pending = append(pending, sample{name: name, labels: sampleLabels, value: value})
+}
+
+// Flush merges the samples of this process into the totals, and writes or pushes them
+func Flush(ctx context.Context) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !config.enabled() || len(pending) == 0 {
+		return
+	}
+
+	text, err := merge()
+	if err != nil {
+		log.Debugf("failed to record metrics: %s\n", err)
+		return
+	}
+	pending = nil
+
+	if config.PushURL != "" {
+		if err := push(ctx, text); err != nil {
+			log.Debugf("failed to push metrics to %s: %s\n", config.PushURL, err)
+		}
+	}
+}
+
+// merge adds the pending samples to the totals under a lock, as stages of concurrent jobs share them,
+// and returns the totals in the text format
+func merge() ([]byte, error) {
+	dir := config.TextfileDir
+	if dir == "" {
+		// apart from the journal and its lock, which the totals lock must not be mistaken for
+		dir = filepath.Join(config.StateDir, "metrics")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	statePath := filepath.Join(dir, stateName)
+
+	unlock, err := filelock.Lock(statePath + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	totals := map[string]*series{}
+	if data, err := os.ReadFile(statePath); err == nil {
+		var saved []*series
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Debugf("discarding unreadable metrics totals %s: %s\n", statePath, err)
+		}
+		for _, s := range saved {
+			// totals of older versions were also labelled by tag
+			if _, ok := s.Labels["tag"]; ok {
+				continue
+			}
+			totals[seriesKey(s.Name, s.Labels)] = s
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, sample := range pending {
+		apply(totals, sample)
+	}
+
+	all := make([]*series, 0, len(totals))
+	for _, s := range totals {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return seriesKey(all[i].Name, all[i].Labels) < seriesKey(all[j].Name, all[j].Labels)
+	})
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(statePath, data, 0600); err != nil {
+		return nil, err
+	}
+
+	text := render(all)
+	if config.TextfileDir != "" {
+		if err := writeFileAtomic(filepath.Join(config.TextfileDir, textfileName), text, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return text, nil
+}
+
+func apply(totals map[string]*series, sample sample) {
+	definition, ok := definitions[sample.name]
+	if !ok {
+		return
+	}
+	key := seriesKey(sample.name, sample.labels)
+	s, ok := totals[key]
+	if !ok {
+		s = &series{Name: sample.name, Labels: sample.labels}
+		totals[key] = s
+	}
+
+	if definition.buckets == nil {
+		s.Value += sample.value
+		return
+	}
+	if len(s.Buckets) != len(definition.buckets) {
+		s.Buckets = make([]uint64, len(definition.buckets))
+	}
+	for i, bound := range definition.buckets {
+		if sample.value <= bound {
+			s.Buckets[i]++
+			break
+		}
+	}
+	s.Sum += sample.value
+	s.Count++
+}
+
+func seriesKey(name string, labels map[string]string) string {
+	return name + formatLabels(labels, "", "")
+}
+
+// render writes the series in the Prometheus text exposition format
+func render(all []*series) []byte {
+	var b bytes.Buffer
+	lastName := ""
+	for _, s := range all {
+		definition, ok := definitions[s.Name]
+		if !ok {
+			continue
+		}
+		if s.Name != lastName {
+			kind := "counter"
+			if definition.buckets != nil {
+				kind = "histogram"
+			}
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", s.Name, definition.help, s.Name, kind)
+			lastName = s.Name
+		}
+
+		if definition.buckets == nil {
+			fmt.Fprintf(&b, "%s%s %s\n", s.Name, formatLabels(s.Labels, "", ""), formatValue(s.Value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range definition.buckets {
+			if i < len(s.Buckets) {
+				cumulative += s.Buckets[i]
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", s.Name, formatLabels(s.Labels, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", s.Name, formatLabels(s.Labels, "le", "+Inf"), s.Count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", s.Name, formatLabels(s.Labels, "", ""), formatValue(s.Sum))
+		fmt.Fprintf(&b, "%s_count%s %d\n", s.Name, formatLabels(s.Labels, "", ""), s.Count)
+	}
+	return b.Bytes()
+}
+
+// formatLabels writes the labels sorted by name, with an optional extra one last, like le of buckets
+func formatLabels(labels map[string]string, extraName string, extraValue string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(labels[name])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, labelEscaper.Replace(extraValue)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// push replaces the metrics of this runner host on the Pushgateway by the totals. The Pushgateway is
+// not the controller: the controller's proxy and TLS settings don't apply, the runner process's do.
+func push(ctx context.Context, text []byte) error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	endpoint := strings.TrimSuffix(config.PushURL, "/") + "/metrics/job/" + namespace + "/instance/" + url.PathEscape(host)
+
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(text))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %q: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file for %q: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions of temp file for %q: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file for %q: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move temp file to %q: %w", path, err)
+	}
+	return nil
+}
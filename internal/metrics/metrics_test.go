@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTextfile(t *testing.T) {
+	dir := t.TempDir()
+	labels := Labels{Template: "macos-14", NodeGroup: "ci", Controller: "https://controller"}
+
+	// two stage processes, merging into the same totals
+	for _, seconds := range []float64{3, 45} {
+		Init(Config{TextfileDir: dir}, labels)
+		Observe(QueueSeconds, seconds)
+		Inc(ErrorsTotal, "stage", "prepare", "category", "capacity")
+		Flush(context.Background())
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, textfileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	series := `{controller="https://controller",node_group="ci",template="macos-14"`
+	for _, expected := range []string{
+		"# TYPE anka_cloud_gitlab_executor_queue_seconds histogram",
+		"anka_cloud_gitlab_executor_queue_seconds_bucket" + series + `,le="1"} 0`,
+		"anka_cloud_gitlab_executor_queue_seconds_bucket" + series + `,le="5"} 1`,
+		"anka_cloud_gitlab_executor_queue_seconds_bucket" + series + `,le="60"} 2`,
+		"anka_cloud_gitlab_executor_queue_seconds_bucket" + series + `,le="+Inf"} 2`,
+		"anka_cloud_gitlab_executor_queue_seconds_sum" + series + "} 48",
+		"anka_cloud_gitlab_executor_queue_seconds_count" + series + "} 2",
+		"# TYPE anka_cloud_gitlab_executor_errors_total counter",
+		`anka_cloud_gitlab_executor_errors_total{category="capacity",controller="https://controller",node_group="ci",stage="prepare",template="macos-14"} 2`,
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected %q in:\n%s", expected, text)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, textfileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("expected textfile readable by node exporter, got %s", info.Mode())
+	}
+}
+
+func TestPush(t *testing.T) {
+	var method, path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	stateDir := t.TempDir()
+	Init(Config{PushURL: server.URL, StateDir: stateDir}, Labels{Template: "macos-14"})
+	Observe(RunStageSeconds, 12, "run_stage", "build_script")
+	Flush(context.Background())
+
+	// the journal owns the state dir itself, totals are kept apart
+	if _, err := os.Stat(filepath.Join(stateDir, "metrics", stateName)); err != nil {
+		t.Errorf("expected totals in the metrics subdirectory: %s", err)
+	}
+	if entries, _ := os.ReadDir(stateDir); len(entries) != 1 {
+		t.Errorf("expected only the metrics subdirectory in the state dir, got %v", entries)
+	}
+
+	host, _ := os.Hostname()
+	if method != http.MethodPut || path != "/metrics/job/anka_cloud_gitlab_executor/instance/"+host {
+		t.Errorf("unexpected push %s %s", method, path)
+	}
+	if !strings.Contains(body, `anka_cloud_gitlab_executor_run_stage_seconds_count{controller="",node_group="",run_stage="build_script",template="macos-14"} 1`) {
+		t.Errorf("unexpected push body:\n%s", body)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	Init(Config{}, Labels{})
+	Observe(QueueSeconds, 1)
+	if len(pending) != 0 {
+		t.Errorf("expected no samples without a sink, got %d", len(pending))
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	got := formatLabels(map[string]string{"template": "a \"b\"\\\n"}, "", "")
+	if got != `{template="a \"b\"\\\n"}` {
+		t.Errorf("unexpected labels %s", got)
+	}
+}
+
+func TestTotalsLabelledByTagDropped(t *testing.T) {
+	dir := t.TempDir()
+	old := `[{"name":"anka_cloud_gitlab_executor_errors_total","labels":{"category":"capacity","stage":"prepare","tag":"v1","template":"macos-14"},"value":3}]`
+	if err := os.WriteFile(filepath.Join(dir, stateName), []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	Init(Config{TextfileDir: dir}, Labels{Template: "macos-14"})
+	defer Init(Config{}, Labels{})
+	Inc(ErrorsTotal, "stage", "prepare", "category", "capacity")
+	Flush(context.Background())
+
+	data, err := os.ReadFile(filepath.Join(dir, textfileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := string(data); strings.Contains(text, "tag=") || !strings.Contains(text, `stage="prepare",template="macos-14"} 1`) {
+		t.Errorf("expected only the new series, got:\n%s", text)
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestBypass(t *testing.T) {
+	config, err := New("http://proxy:3128", ParseNoProxy("example.com, .internal.net,10.0.0.0/8, 192.168.1.1, node:2222"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr   string
+		bypass bool
+	}{
+		{"example.com", true},
+		{"controller.example.com:443", true},
+		{"notexample.com", false},
+		{"a.internal.net", true},
+		{"internal.net", true},
+		{"10.1.2.3:8090", true},
+		{"11.1.2.3:8090", false},
+		{"192.168.1.1:22", true},
+		{"192.168.1.2:22", false},
+		{"node:2222", true},
+		{"node:2223", false},
+		{"controller:80", false},
+	}
+	for _, test := range tests {
+		if got := config.Bypass(test.addr); got != test.bypass {
+			t.Errorf("Bypass(%q): expected %t, got %t", test.addr, test.bypass, got)
+		}
+	}
+
+	all, _ := New("socks5://proxy", []string{"*"})
+	if !all.Bypass("anything:22") {
+		t.Errorf("expected * to bypass everything")
+	}
+}
+
+func TestNew_InvalidScheme(t *testing.T) {
+	if _, err := New("ftp://proxy:21", nil); err == nil {
+		t.Errorf("expected error for unsupported scheme")
+	}
+}
+
+// echoServer echoes back whatever it reads, standing in for the SSH server
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("expected echo through the tunnel, got %q", buf)
+	}
+}
+
+func TestDialContext_HTTPConnect(t *testing.T) {
+	target := echoServer(t)
+
+	var proxyAuth string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyAuth = r.Header.Get("Proxy-Authorization")
+		if r.Method != http.MethodConnect || r.Host != target {
+			t.Errorf("expected CONNECT to %s, got %s %s", target, r.Method, r.Host)
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+	}))
+	defer proxyServer.Close()
+
+	config, err := New("http://user:secret@"+proxyServer.Listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := config.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if proxyAuth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("expected basic proxy credentials, got %q", proxyAuth)
+	}
+	assertEcho(t, conn)
+}
+
+func TestDialContext_SOCKS5(t *testing.T) {
+	target := echoServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var username, password string
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		header := make([]byte, 2)
+		io.ReadFull(r, header)
+		io.ReadFull(r, make([]byte, header[1]))
+		conn.Write([]byte{0x05, 0x02})
+
+		readString := func() string {
+			length, _ := r.ReadByte()
+			s := make([]byte, length)
+			io.ReadFull(r, s)
+			return string(s)
+		}
+		r.ReadByte()
+		username, password = readString(), readString()
+		conn.Write([]byte{0x01, 0x00})
+
+		request := make([]byte, 4)
+		io.ReadFull(r, request)
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(r, ip)
+		port := make([]byte, 2)
+		io.ReadFull(r, port)
+		upstream, err := net.Dial("tcp", net.JoinHostPort(net.IP(ip).String(), strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+		if err != nil {
+			conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		go func() {
+			io.Copy(upstream, r)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+	}()
+
+	config, err := New("socks5://user:secret@"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := config.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn)
+	if username != "user" || password != "secret" {
+		t.Errorf("expected SOCKS credentials user:secret, got %s:%s", username, password)
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	var proxied bool
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.Host == "controller.test:8090"
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+
+	config, err := New(proxyServer.URL, []string{"direct.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: config.HTTPProxy}}
+
+	r, err := client.Get("http://controller.test:8090/api/v1/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if !proxied {
+		t.Errorf("expected request to go through the proxy")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://direct.test/api/v1/status", nil)
+	if u, _ := config.HTTPProxy(req); u != nil {
+		t.Errorf("expected no-proxy host to be reached directly, got proxy %s", u)
+	}
+}
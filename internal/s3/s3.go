@@ -0,0 +1,156 @@
+// Package s3 uploads objects to S3-compatible storage using AWS Signature Version 4,
+// without pulling in an SDK.
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion  = "us-east-1"
+	defaultTimeout = 5 * time.Minute
+	service        = "s3"
+	algorithm      = "AWS4-HMAC-SHA256"
+)
+
+type Credentials struct {
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token,omitempty"`
+	Region          string `json:"region,omitempty"`
+}
+
+// LoadCredentials reads credentials from a JSON file on the runner host.
+func LoadCredentials(path string) (Credentials, error) {
+	var creds Credentials
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return creds, fmt.Errorf("failed to read s3 credentials file %q: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, fmt.Errorf("failed to parse s3 credentials file %q: %w", path, err)
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("s3 credentials file %q must contain access_key_id and secret_access_key", path)
+	}
+	return creds, nil
+}
+
+type Client struct {
+	Credentials Credentials
+	HttpClient  *http.Client
+	now         func() time.Time
+}
+
+func NewClient(creds Credentials) *Client {
+	if creds.Region == "" {
+		creds.Region = defaultRegion
+	}
+	return &Client{
+		Credentials: creds,
+		HttpClient:  &http.Client{Timeout: defaultTimeout},
+		now:         time.Now,
+	}
+}
+
+// PutObject uploads the file to objectURL, a path-style URL such as https://s3.example.com/bucket/key.
+func (c *Client) PutObject(ctx context.Context, objectURL string, file *os.File) error {
+	u, err := url.Parse(objectURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse object url %q: %w", objectURL, err)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("failed to hash %q: %w", file.Name(), err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind %q: %w", file.Name(), err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), file)
+	if err != nil {
+		return fmt.Errorf("failed to create PUT request to %q: %w", objectURL, err)
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.sign(req, hex.EncodeToString(hash.Sum(nil)))
+
+	r, err := c.HttpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send PUT request to %s: %w", objectURL, err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, 4096))
+		return fmt.Errorf("status code: %d, error: %s", r.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (c *Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.Credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.Credentials.SessionToken)
+	}
+
+	var headerNames []string
+	for name := range req.Header {
+		headerNames = append(headerNames, strings.ToLower(name))
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(fmt.Sprintf("%s:%s\n", name, strings.TrimSpace(req.Header.Get(name))))
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, c.Credentials.Region, service)
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.Credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Credentials.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, c.Credentials.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
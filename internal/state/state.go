@@ -0,0 +1,147 @@
+// Package state keeps a small per-job journal on the runner host, so separate stage
+// processes (and the reaper) can share what they know about a job's instance.
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/filelock"
+)
+
+const fileSuffix = ".json"
+
+type Job struct {
+	JobURL         string    `json:"job_url"`
+	ProjectId      string    `json:"project_id,omitempty"`
+	InstanceId     string    `json:"instance_id,omitempty"`
+	ControllerURL  string    `json:"controller_url,omitempty"`
+	TemplateId     string    `json:"template_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	KeepAliveUntil time.Time `json:"keep_alive_until,omitzero"`
+}
+
+func (j Job) IsKeptAlive(now time.Time) bool {
+	return !j.KeepAliveUntil.IsZero() && now.Before(j.KeepAliveUntil)
+}
+
+func (j Job) KeepAliveExpired(now time.Time) bool {
+	return !j.KeepAliveUntil.IsZero() && !now.Before(j.KeepAliveUntil)
+}
+
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state dir %q: %w", dir, err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Lock keeps other processes of the runner host from changing the journal until the returned function
+// is called, for decisions made over all of its entries.
+func (s *Store) Lock() (func(), error) {
+	unlock, err := filelock.Lock(filepath.Join(s.dir, ".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock state dir %q: %w", s.dir, err)
+	}
+	return unlock, nil
+}
+
+func (s *Store) path(jobURL string) string {
+	sum := sha256.Sum256([]byte(jobURL))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:16])+fileSuffix)
+}
+
+// Save atomically writes the job entry, replacing any previous entry of the same job.
+func (s *Store) Save(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job state %+v: %w", job, err)
+	}
+
+	return writeFileAtomic(s.path(job.JobURL), data)
+}
+
+// Load returns the entry of the job, and false if there is none.
+func (s *Store) Load(jobURL string) (Job, bool, error) {
+	var job Job
+	data, err := os.ReadFile(s.path(jobURL))
+	if errors.Is(err, os.ErrNotExist) {
+		return job, false, nil
+	}
+	if err != nil {
+		return job, false, fmt.Errorf("failed to read state of job %q: %w", jobURL, err)
+	}
+
+	if err := json.Unmarshal(data, &job); err != nil {
+		return job, false, fmt.Errorf("failed to parse state of job %q: %w", jobURL, err)
+	}
+	return job, true, nil
+}
+
+func (s *Store) Remove(jobURL string) error {
+	err := os.Remove(s.path(jobURL))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove state of job %q: %w", jobURL, err)
+	}
+	return nil
+}
+
+func (s *Store) List() ([]Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list state dir %q: %w", s.dir, err)
+	}
+
+	var jobs []Job
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), fileSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read state file %q: %w", entry.Name(), err)
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			// a corrupted entry should not hide the rest of the journal
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %q: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file for %q: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file for %q: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move temp file to %q: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreRoundTrip(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := Job{
+		JobURL:     "https://gitlab.com/group/project/-/jobs/123",
+		ProjectId:  "42",
+		InstanceId: "fake-instance-id",
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	if err := store.Save(job); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, ok, err := store.Load(job.JobURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected job state to exist")
+	}
+	if loaded != job {
+		t.Errorf("expected %+v, got %+v", job, loaded)
+	}
+
+	jobs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("expected 1 job, got %d", len(jobs))
+	}
+
+	if err := store.Remove(job.JobURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Load(job.JobURL); ok {
+		t.Error("expected job state to be removed")
+	}
+	if err := store.Remove(job.JobURL); err != nil {
+		t.Errorf("expected removing a missing job to succeed, got %v", err)
+	}
+}
+
+func TestStoreListSkipsCorruptedEntries(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save(Job{JobURL: "https://gitlab.com/group/project/-/jobs/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(store.Dir(), "corrupted.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Errorf("expected 1 job, got %d", len(jobs))
+	}
+}
+
+func TestJobKeepAlive(t *testing.T) {
+	now := time.Now()
+
+	job := Job{}
+	if job.IsKeptAlive(now) || job.KeepAliveExpired(now) {
+		t.Error("expected job without keep alive to be neither kept alive nor expired")
+	}
+
+	job.KeepAliveUntil = now.Add(time.Hour)
+	if !job.IsKeptAlive(now) || job.KeepAliveExpired(now) {
+		t.Error("expected job to be kept alive")
+	}
+
+	job.KeepAliveUntil = now.Add(-time.Hour)
+	if job.IsKeptAlive(now) || !job.KeepAliveExpired(now) {
+		t.Error("expected job keep alive to be expired")
+	}
+}
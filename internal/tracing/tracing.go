@@ -0,0 +1,315 @@
+// Package tracing records a single trace per job, although the job is split across processes
+// (config, prepare, run for each step, cleanup). The first stage creates the trace and stores its
+// context in a per-job file, the following ones add their spans to it, and cleanup ends it. Spans
+// are exported at the end of each stage, over OTLP/HTTP with the JSON encoding, or appended to a file
+// in the same format. Spans that can't be exported are dropped, with a debug message.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+const (
+	serviceName   = "anka-cloud-gitlab-executor"
+	exportTimeout = 5 * time.Second
+)
+
+// span kinds of OTLP
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+type Config struct {
+	// Endpoint is the OTLP/HTTP collector, like http://localhost:4318
+	Endpoint string
+	Headers  map[string]string
+	// File is appended one OTLP JSON export request per stage
+	File string
+	// Dir keeps the trace context of the jobs between stages
+	Dir string
+	// Version is reported as service.version
+	Version string
+}
+
+func (c Config) enabled() bool {
+	return c.Endpoint != "" || c.File != ""
+}
+
+// jobContext is what the stages of a job share through the per-job file
+type jobContext struct {
+	TraceId   string    `json:"trace_id"`
+	SpanId    string    `json:"span_id"`
+	StartTime time.Time `json:"start_time"`
+}
+
+type Span struct {
+	traceId      string
+	spanId       string
+	parentSpanId string
+	name         string
+	kind         int
+	start        time.Time
+	end          time.Time
+	attributes   map[string]any
+	err          string
+}
+
+type spanKey struct{}
+
+var (
+	mu        sync.Mutex
+	config    Config
+	jobURL    string
+	job       *jobContext
+	stageSpan *Span
+	ended     []*Span
+)
+
+// Init joins the trace of the job, creating it on the first stage, and starts the span of the stage.
+// The returned context carries the stage span, as the parent of the spans started with it.
+func Init(ctx context.Context, c Config, url string, stage string) context.Context {
+	mu.Lock()
+	config = c
+	jobURL = url
+	ended = nil
+	job = nil
+	stageSpan = nil
+	if !c.enabled() {
+		mu.Unlock()
+		return ctx
+	}
+
+	loaded, err := loadJobContext()
+	if err != nil {
+		log.Debugf("failed to load trace context of job %s, starting a new trace: %s\n", url, err)
+	}
+	if loaded == nil {
+		loaded = &jobContext{TraceId: newId(16), SpanId: newId(8), StartTime: time.Now()}
+		if err := saveJobContext(loaded); err != nil {
+			log.Debugf("failed to save trace context of job %s: %s\n", url, err)
+		}
+	}
+	job = loaded
+	mu.Unlock()
+
+	parent := &Span{traceId: job.TraceId, spanId: job.SpanId}
+	ctx, stageSpan = Start(context.WithValue(ctx, spanKey{}, parent), stage, KindInternal)
+	stageSpan.SetAttribute("gitlab.job.url", url)
+	stageSpan.SetAttribute("gitlab.stage", stage)
+	return ctx
+}
+
+// Start starts a span, as a child of the span of ctx. It returns a nil span if tracing is off, which
+// is safe to use.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok || parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		traceId:      parent.traceId,
+		spanId:       newId(8),
+		parentSpanId: parent.spanId,
+		name:         name,
+		kind:         kind,
+		start:        time.Now(),
+		attributes:   map[string]any{},
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	s.err = log.Redact(err.Error())
+}
+
+// End ends the span, to be exported at the end of the stage. Ending it again does nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	ended = append(ended, s)
+}
+
+// Traceparent is the W3C trace context header value of the span of ctx, empty if tracing is off
+func Traceparent(ctx context.Context) string {
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok || span == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", span.traceId, span.spanId)
+}
+
+// EndJob ends the trace of the job, once its last stage is done
+func EndJob() {
+	mu.Lock()
+	defer mu.Unlock()
+	if job == nil {
+		return
+	}
+	ended = append(ended, &Span{
+		traceId:    job.TraceId,
+		spanId:     job.SpanId,
+		name:       "job",
+		kind:       KindInternal,
+		start:      job.StartTime,
+		end:        time.Now(),
+		attributes: map[string]any{"gitlab.job.url": jobURL},
+	})
+	if err := os.Remove(jobContextPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Debugf("failed to remove trace context of job %s: %s\n", jobURL, err)
+	}
+	job = nil
+}
+
+// Flush ends the span of the stage, failed if err is set, and exports the spans of the stage
+func Flush(ctx context.Context, err error) {
+	stageSpan.SetError(err)
+	stageSpan.End()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !config.enabled() || len(ended) == 0 {
+		return
+	}
+
+	data, encodeErr := json.Marshal(exportRequest(ended))
+	if encodeErr != nil {
+		log.Debugf("failed to encode spans: %s\n", encodeErr)
+		return
+	}
+	ended = nil
+
+	if config.File != "" {
+		if err := appendLine(config.File, data); err != nil {
+			log.Debugf("failed to write spans to %s: %s\n", config.File, err)
+		}
+	}
+	if config.Endpoint != "" {
+		if err := export(ctx, data); err != nil {
+			log.Debugf("failed to export spans to %s: %s\n", config.Endpoint, err)
+		}
+	}
+}
+
+func jobContextPath() string {
+	dir := config.Dir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), serviceName)
+	}
+	hash := sha256.Sum256([]byte(jobURL))
+	return filepath.Join(dir, "trace-"+hex.EncodeToString(hash[:8])+".json")
+}
+
+func loadJobContext() (*jobContext, error) {
+	data, err := os.ReadFile(jobContextPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var loaded jobContext
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, err
+	}
+	if len(loaded.TraceId) != 32 || len(loaded.SpanId) != 16 {
+		return nil, fmt.Errorf("invalid trace context %+v", loaded)
+	}
+	return &loaded, nil
+}
+
+func saveJobContext(c *jobContext) error {
+	path := jobContextPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func appendLine(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func export(ctx context.Context, data []byte) error {
+	endpoint := strings.TrimSuffix(config.Endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func newId(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func readSpans(t *testing.T, path string) []otlpSpan {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var spans []otlpSpan
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var request otlpRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			t.Fatal(err)
+		}
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func TestTraceAcrossStages(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{File: filepath.Join(dir, "traces.jsonl"), Dir: dir}
+	jobURL := "https://gitlab.com/group/project/-/jobs/1"
+
+	ctx := Init(context.Background(), config, jobURL, "prepare")
+	_, span := Start(ctx, "GET /api/v1/vm", KindClient)
+	span.SetAttribute("http.response.status_code", 200)
+	span.End()
+	Flush(context.Background(), nil)
+
+	ctx = Init(context.Background(), config, jobURL, "cleanup")
+	EndJob()
+	Flush(ctx, errors.New("failed with token=abcd1234"))
+
+	if _, err := os.Stat(jobContextPath()); !os.IsNotExist(err) {
+		t.Errorf("expected trace context of the job to be removed, got %v", err)
+	}
+
+	spans := readSpans(t, config.File)
+	byName := map[string]otlpSpan{}
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	job, prepare, request, cleanup := byName["job"], byName["prepare"], byName["GET /api/v1/vm"], byName["cleanup"]
+	if len(spans) != 4 || job.SpanId == "" {
+		t.Fatalf("expected job, prepare, request and cleanup spans, got %+v", spans)
+	}
+	for _, span := range spans {
+		if span.TraceId != job.TraceId {
+			t.Errorf("expected a single trace, got %s and %s", span.TraceId, job.TraceId)
+		}
+	}
+	if prepare.ParentSpanId != job.SpanId || cleanup.ParentSpanId != job.SpanId || request.ParentSpanId != prepare.SpanId {
+		t.Errorf("unexpected span parents %+v", spans)
+	}
+	if cleanup.Status.Code != statusError || cleanup.Status.Message != "failed with token=[REDACTED]" {
+		t.Errorf("expected failed cleanup span with redacted message, got %+v", cleanup.Status)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	if Traceparent(context.Background()) != "" {
+		t.Error("expected no traceparent without tracing")
+	}
+
+	dir := t.TempDir()
+	ctx := Init(context.Background(), Config{File: filepath.Join(dir, "traces.jsonl"), Dir: dir}, "job", "run")
+	if !regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`).MatchString(Traceparent(ctx)) {
+		t.Errorf("unexpected traceparent %q", Traceparent(ctx))
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var path, authorization string
+	var request otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, authorization = r.URL.Path, r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &request)
+	}))
+	defer server.Close()
+
+	Init(context.Background(), Config{Endpoint: server.URL, Headers: map[string]string{"Authorization": "Bearer collector"}, Dir: t.TempDir()}, "job", "config")
+	Flush(context.Background(), nil)
+
+	if path != "/v1/traces" || authorization != "Bearer collector" {
+		t.Errorf("unexpected export to %s with %q", path, authorization)
+	}
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Errorf("expected the config stage span, got %+v", request)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx := Init(context.Background(), Config{}, "job", "prepare")
+	_, span := Start(ctx, "GET /api/v1/vm", KindClient)
+	if span != nil {
+		t.Error("expected no span without an exporter")
+	}
+	span.SetAttribute("key", "value")
+	span.End()
+	Flush(ctx, nil)
+}
@@ -0,0 +1,198 @@
+// Package webhook tells other tools, like chatops or cost tracking, about the lifecycle of the job's
+// VM. Payloads are JSON, signed with an HMAC-SHA256 of the body. Delivery is retried, and giving up
+// only leaves a warning in the job log.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/veertuinc/anka-cloud-gitlab-executor/internal/log"
+)
+
+const (
+	EventProvisioned = "instance.provisioned"
+	EventFailed      = "instance.failed"
+	EventKeptAlive   = "instance.kept_alive"
+	EventTerminated  = "instance.terminated"
+)
+
+const (
+	SignatureHeader = "X-Anka-Signature"
+	EventHeader     = "X-Anka-Event"
+	DeliveryHeader  = "X-Anka-Delivery"
+
+	DefaultTimeout  = 5 * time.Second
+	DefaultAttempts = 3
+)
+
+// retryDelay grows linearly with the attempts
+var retryDelay = time.Second
+
+type Config struct {
+	URLs []string
+	// Secret signs the payloads, SignatureHeader is "sha256=" and the hex HMAC-SHA256 of the body
+	Secret string
+	// Timeout bounds each delivery attempt
+	Timeout  time.Duration
+	Attempts int
+}
+
+type Job struct {
+	URL        string `json:"url"`
+	ProjectId  string `json:"project_id,omitempty"`
+	PipelineId string `json:"pipeline_id,omitempty"`
+	Stage      string `json:"stage,omitempty"`
+}
+
+type Instance struct {
+	Id         string `json:"id,omitempty"`
+	VMName     string `json:"vm_name,omitempty"`
+	NodeId     string `json:"node_id,omitempty"`
+	NodeName   string `json:"node_name,omitempty"`
+	NodeIP     string `json:"node_ip,omitempty"`
+	TemplateId string `json:"template_id,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Controller string `json:"controller,omitempty"`
+}
+
+type Payload struct {
+	Event          string    `json:"event"`
+	Time           time.Time `json:"time"`
+	Job            Job       `json:"job"`
+	Instance       Instance  `json:"instance"`
+	KeepAliveUntil time.Time `json:"keep_alive_until,omitzero"`
+	Error          string    `json:"error,omitempty"`
+}
+
+var (
+	mu     sync.Mutex
+	config Config
+	job    Job
+)
+
+// Init sets where payloads go, and the job they are about
+func Init(c Config, j Job) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.Attempts < 1 {
+		c.Attempts = DefaultAttempts
+	}
+	config = c
+	job = j
+}
+
+// Send delivers the payloads to every webhook URL, filling the time and the job. Deliveries run
+// concurrently, so Send takes as long as the slowest of them: at most Attempts times Timeout, plus
+// the retry delays.
+func Send(ctx context.Context, payloads ...Payload) {
+	mu.Lock()
+	c := config
+	j := job
+	mu.Unlock()
+
+	if len(c.URLs) == 0 {
+		return
+	}
+
+	// the job may be canceled already, say for cleanup after a canceled job, but still deserves its webhooks
+	ctx = context.WithoutCancel(ctx)
+	var wg sync.WaitGroup
+	for _, payload := range payloads {
+		payload.Job = j
+		if payload.Time.IsZero() {
+			payload.Time = time.Now().UTC()
+		}
+		payload.Error = log.Redact(payload.Error)
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Warnf("failed to encode %s webhook payload: %s\n", payload.Event, err)
+			continue
+		}
+
+		delivery := newDeliveryId()
+		for _, url := range c.URLs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := deliver(ctx, c, url, payload.Event, delivery, body); err != nil {
+					log.Warnf("failed to deliver %s webhook to %s: %s\n", payload.Event, url, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func deliver(ctx context.Context, c Config, url string, event string, delivery string, body []byte) error {
+	var err error
+	for attempt := 1; attempt <= c.Attempts; attempt++ {
+		var retry bool
+		retry, err = post(ctx, c, url, event, delivery, body)
+		if err == nil || !retry {
+			return err
+		}
+		if attempt < c.Attempts {
+			log.Debugf("%s webhook to %s failed (attempt %d/%d): %s\n", event, url, attempt, c.Attempts, err)
+			time.Sleep(retryDelay * time.Duration(attempt))
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", c.Attempts, err)
+}
+
+// post sends the payload once, and tells if a failure is worth another try
+func post(ctx context.Context, c Config, url string, event string, delivery string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, delivery)
+	if c.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(c.Secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("status code %d", resp.StatusCode)
+}
+
+// Sign is the SignatureHeader value of the body, for receivers to compare with hmac.Equal
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDeliveryId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
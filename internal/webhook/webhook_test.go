@@ -0,0 +1,154 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	retryDelay = time.Millisecond
+}
+
+func TestSend(t *testing.T) {
+	var received Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := r.Header.Get(SignatureHeader); got != Sign("secret", body) {
+			t.Errorf("expected signature %q, got %q", Sign("secret", body), got)
+		}
+		if got := r.Header.Get(EventHeader); got != EventProvisioned {
+			t.Errorf("expected event header %q, got %q", EventProvisioned, got)
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	Init(Config{URLs: []string{server.URL}, Secret: "secret"}, Job{URL: "https://gitlab.example.com/job/1", Stage: "prepare"})
+	defer Init(Config{}, Job{})
+
+	Send(context.Background(), Payload{Event: EventProvisioned, Instance: Instance{Id: "instance-1", NodeIP: "10.0.0.1"}})
+
+	if received.Event != EventProvisioned {
+		t.Errorf("expected event %q, got %q", EventProvisioned, received.Event)
+	}
+	if received.Job.URL != "https://gitlab.example.com/job/1" || received.Job.Stage != "prepare" {
+		t.Errorf("expected job to be filled, got %+v", received.Job)
+	}
+	if received.Instance.Id != "instance-1" || received.Instance.NodeIP != "10.0.0.1" {
+		t.Errorf("unexpected instance %+v", received.Instance)
+	}
+	if received.Time.IsZero() {
+		t.Error("expected time to be set")
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		expected int32
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, expected: 1},
+		{name: "server error then success", statuses: []int{http.StatusInternalServerError, http.StatusOK}, expected: 2},
+		{name: "too many requests", statuses: []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests}, expected: 3},
+		{name: "client error", statuses: []int{http.StatusBadRequest}, expected: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := requests.Add(1)
+				w.WriteHeader(test.statuses[min(int(n), len(test.statuses))-1])
+			}))
+			defer server.Close()
+
+			Init(Config{URLs: []string{server.URL}, Attempts: 3}, Job{})
+			defer Init(Config{}, Job{})
+
+			Send(context.Background(), Payload{Event: EventTerminated})
+
+			if got := requests.Load(); got != test.expected {
+				t.Errorf("expected %d requests, got %d", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	var requests atomic.Int32
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	Init(Config{URLs: []string{server.URL}, Timeout: 50 * time.Millisecond, Attempts: 2}, Job{})
+	defer Init(Config{}, Job{})
+
+	start := time.Now()
+	Send(context.Background(), Payload{Event: EventFailed})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected delivery to give up quickly, took %s", elapsed)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("expected 2 requests, got %d", got)
+	}
+}
+
+func TestSendCanceledContext(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	Init(Config{URLs: []string{server.URL}}, Job{})
+	defer Init(Config{}, Job{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	Send(ctx, Payload{Event: EventTerminated})
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected webhook to be delivered despite the canceled context, got %d requests", got)
+	}
+}
+
+func TestSendConcurrently(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	Init(Config{URLs: []string{server.URL, server.URL + "/other"}}, Job{})
+	defer Init(Config{}, Job{})
+
+	start := time.Now()
+	Send(context.Background(),
+		Payload{Event: EventTerminated, Instance: Instance{Id: "instance-1"}},
+		Payload{Event: EventTerminated, Instance: Instance{Id: "instance-2"}},
+		Payload{Event: EventTerminated, Instance: Instance{Id: "instance-3"}},
+	)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected deliveries to run concurrently, took %s", elapsed)
+	}
+	if got := requests.Load(); got != 6 {
+		t.Errorf("expected 6 requests, got %d", got)
+	}
+}